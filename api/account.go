@@ -0,0 +1,429 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "archive/zip"
+    "reflect"
+    "strconv"
+    "bytes"
+    "sort"
+    "time"
+    "fmt"
+    "io"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+const (
+    manifestFile = "manifest.json"
+    archiveVersion = 1
+    // largest archive accepted by /account/import
+    maxImportSize = 64 << 20
+)
+
+// describes the contents of an account archive
+type manifest struct {
+    Version int `json:"version"`
+    ExportedAt time.Time `json:"exported_at"`
+    UserId int64 `json:"user_id"`
+    Types map[string]manifestEntry `json:"types"`
+}
+
+type manifestEntry struct {
+    File string `json:"file"`
+    Count int `json:"count"`
+}
+
+// data types included in account archives - those owned or authored by a user,
+// other than the user record itself
+func accountTypes() []string {
+    names := make([]string, 0)
+    for dataType, metaData := range types.MetaDataMap {
+        if _, ok := writerColumn(metaData); ok {
+            names = append(names, dataType)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// the owner_id or author_id column of a data type, when it isn't also the id
+func writerColumn(metaData types.MetaData) (store.Column, bool) {
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        isId, isWriter := false, false
+        for _, role := range col.Roles {
+            isId = isId || role == "id"
+            isWriter = isWriter || role == "owner_id" || role == "author_id"
+        }
+        if isWriter && !isId {
+            return col, true
+        }
+    }
+    return store.Column{}, false
+}
+
+// a zip of every record the session owns or authored, a json array per data type
+// plus a manifest. records are streamed from the store into the archive
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", `attachment; filename="glonk-export.zip"`)
+    w.Header().Set("Cache-Control", "private, no-store")
+    archive := zip.NewWriter(w)
+    m := manifest{
+        Version: archiveVersion,
+        ExportedAt: time.Now().UTC(),
+        UserId: ownerId,
+        Types: make(map[string]manifestEntry),
+    }
+    for _, dataType := range accountTypes() {
+        entry, err := s.exportType(archive, dataType, ownerId)
+        if err != nil {
+            // the archive is already underway and is cut short
+            log.Printf("Could not export %s: %v\n", dataType, err)
+            return
+        }
+        m.Types[dataType] = entry
+    }
+    file, err := archive.Create(manifestFile)
+    if err == nil {
+        err = json.NewEncoder(file).Encode(m)
+    }
+    if err == nil {
+        err = archive.Close()
+    }
+    if err != nil {
+        log.Println("Could not write export:", err)
+    }
+}
+
+func (s *Server) exportType(archive *zip.Writer, dataType string, ownerId int64) (manifestEntry, error) {
+    metaData := types.MetaDataMap[dataType]
+    entry := manifestEntry{ File: dataType + ".json" }
+    file, err := archive.Create(entry.File)
+    if err != nil {
+        return entry, err
+    }
+    writerCol, _ := writerColumn(metaData)
+    order, err := types.SortFromQueryParam("id", []string{"id"})
+    if err != nil {
+        return entry, err
+    }
+    queries := []types.Query{ types.NewById(writerCol.Name, []int64{ownerId}), order }
+
+    if _, err := io.WriteString(file, "["); err != nil {
+        return entry, err
+    }
+    for record, err := range s.db.StreamByQueries(metaData, queries, ownerId) {
+        if err != nil {
+            return entry, err
+        }
+        doc, err := redact(record, ownerId)
+        if err != nil {
+            return entry, err
+        }
+        encoded, err := json.Marshal(doc)
+        if err != nil {
+            return entry, err
+        }
+        if entry.Count > 0 {
+            io.WriteString(file, ",")
+        }
+        if _, err := file.Write(encoded); err != nil {
+            return entry, err
+        }
+        entry.Count++
+    }
+    _, err = io.WriteString(file, "]\n")
+    return entry, err
+}
+
+// records of one data type read from an archive, keyed by their exported ids
+type importBatch struct {
+    metaData types.MetaData
+    oldIds []int64
+    records []types.DataType
+}
+
+// reads and validates the records of dataType from an archive, re-owned by ownerId
+func readImport(archive *zip.Reader, dataType string, entry manifestEntry, ownerId int64) (*importBatch, error) {
+    metaData, exists := types.MetaDataMap[dataType]
+    if _, ok := writerColumn(metaData); !exists || !ok {
+        return nil, fmt.Errorf("%s is not an importable data type", dataType)
+    }
+    file, err := archive.Open(entry.File)
+    if err != nil {
+        return nil, fmt.Errorf("archive has no %s", entry.File)
+    }
+    defer file.Close()
+    var docs []json.RawMessage
+    if err := json.NewDecoder(file).Decode(&docs); err != nil {
+        return nil, fmt.Errorf("%s is not a json array: %v", entry.File, err)
+    }
+
+    batch := &importBatch{ metaData: metaData }
+    for i, doc := range docs {
+        target := reflect.New(metaData.GetType())
+        if err := json.Unmarshal(doc, target.Interface()); err != nil {
+            return nil, fmt.Errorf("%s[%d]: %v", dataType, i, err)
+        }
+        data, ok := target.Elem().Interface().(types.DataType)
+        if !ok {
+            return nil, fmt.Errorf("%s is not a DataType", dataType)
+        }
+        batch.oldIds = append(batch.oldIds, store.GetId(data))
+        if data, err = store.SetId(data, 0); err == nil {
+            data, err = store.SetWriterId(data, ownerId)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s[%d]: %v", dataType, i, err)
+        }
+        data = withServerOnly(data, nil)
+        if !data.Validate() {
+            return nil, fmt.Errorf("%s[%d] is invalid", dataType, i)
+        }
+        batch.records = append(batch.records, data)
+    }
+    return batch, nil
+}
+
+// data types in an order where every belongs_to target in the archive comes before
+// the types referencing it
+func importOrder(batches map[string]*importBatch) ([]string, error) {
+    order := make([]string, 0, len(batches))
+    placed := make(map[string]bool)
+    for len(order) < len(batches) {
+        progressed := false
+        for _, dataType := range sortedKeys(batches) {
+            if placed[dataType] {
+                continue
+            }
+            relations, err := store.GetRelations(batches[dataType].metaData.GetType())
+            if err != nil {
+                return nil, err
+            }
+            ready := true
+            for _, relation := range relations {
+                _, imported := batches[relation.Target]
+                if relation.Kind == "belongs_to" && imported && relation.Target != dataType && !placed[relation.Target] {
+                    ready = false
+                }
+            }
+            if ready {
+                order = append(order, dataType)
+                placed[dataType] = true
+                progressed = true
+            }
+        }
+        if !progressed {
+            return nil, fmt.Errorf("archive data types reference each other in a cycle")
+        }
+    }
+    return order, nil
+}
+
+func sortedKeys(batches map[string]*importBatch) []string {
+    keys := make([]string, 0, len(batches))
+    for key := range batches {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// points belongs_to columns referencing imported records at their new ids
+func remap(batch *importBatch, ids map[string]map[int64]int64) error {
+    relations, err := store.GetRelations(batch.metaData.GetType())
+    if err != nil {
+        return err
+    }
+    for i, record := range batch.records {
+        for _, relation := range relations {
+            targetIds, imported := ids[relation.Target]
+            if relation.Kind != "belongs_to" || !imported {
+                continue
+            }
+            oldId, err := int64Column(record, relation.LocalCol)
+            if err != nil {
+                return err
+            }
+            newId, exists := targetIds[oldId]
+            if !exists {
+                return fmt.Errorf("%s[%d] references %s %d, which is not in the archive", record.TypeString(), i, relation.Target, oldId)
+            }
+            if record, err = store.SetColumnInt(record, relation.LocalCol, newId); err != nil {
+                return err
+            }
+        }
+        batch.records[i] = record
+    }
+    return nil
+}
+
+// re-creates the records of an export archive under the session's user. every record is
+// validated before any are written, then every data type is created in one transaction with
+// references between imported records remapped to their new ids
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+    if err != nil {
+        log.Println("Could not read import:", err)
+        http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+        return
+    }
+    archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+    if err != nil {
+        log.Println("Could not read import:", err)
+        http.Error(w, "Import must be a zip archive", http.StatusBadRequest)
+        return
+    }
+    file, err := archive.Open(manifestFile)
+    if err != nil {
+        http.Error(w, "Archive has no " + manifestFile, http.StatusBadRequest)
+        return
+    }
+    var m manifest
+    err = json.NewDecoder(file).Decode(&m)
+    file.Close()
+    if err != nil || m.Version != archiveVersion {
+        log.Println("Invalid import manifest:", err)
+        http.Error(w, "Unsupported archive manifest", http.StatusBadRequest)
+        return
+    }
+
+    batches := make(map[string]*importBatch)
+    for dataType, entry := range m.Types {
+        batch, err := readImport(archive, dataType, entry, ownerId)
+        if err != nil {
+            log.Println("Invalid import:", err)
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        batches[dataType] = batch
+    }
+    order, err := importOrder(batches)
+    if err != nil {
+        log.Println("Invalid import:", err)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // held until the import is stored, taken in name order so concurrent imports can't deadlock
+    for _, dataType := range sortedKeys(batches) {
+        unlock, ok := s.holdQuota(w, dataType, ownerId)
+        if !ok {
+            return
+        }
+        defer unlock()
+    }
+    for _, dataType := range order {
+        var size int64
+        for _, record := range batches[dataType].records {
+            recordSize, err := store.RecordBytes(record)
+            if err != nil {
+                log.Println("Could not size import:", err)
+                http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+                return
+            }
+            size += recordSize
+        }
+        if !s.withinQuota(w, dataType, ownerId, int64(len(batches[dataType].records)), size) {
+            return
+        }
+    }
+
+    // every data type is created in one transaction, so a failed import leaves nothing
+    // behind to be duplicated by a retry
+    ids := make(map[string]map[int64]int64)
+    mapIds := func(dataType string, created []types.DataType) {
+        ids[dataType] = make(map[int64]int64)
+        for i, record := range created {
+            ids[dataType][batches[dataType].oldIds[i]] = store.GetId(record)
+        }
+    }
+    records := make([][]types.DataType, 0, len(order))
+    for _, dataType := range order {
+        records = append(records, batches[dataType].records)
+    }
+    var invalid error
+    created, err := s.db.CreateBatches(records, func(i int, created [][]types.DataType) error {
+        if i > 0 {
+            mapIds(order[i - 1], created[i - 1])
+        }
+        invalid = remap(batches[order[i]], ids)
+        return invalid
+    })
+    if invalid != nil {
+        log.Println("Invalid import:", invalid)
+        http.Error(w, invalid.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        log.Println("Could not import:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    for i, dataType := range order {
+        mapIds(dataType, created[i])
+        for _, record := range created[i] {
+            s.audit(r.Context(), ownerId, auditImport, nil, record)
+        }
+    }
+
+    // exported id -> created id per data type
+    imported := make(map[string]map[string]int64)
+    for dataType, mapping := range ids {
+        imported[dataType] = make(map[string]int64)
+        for oldId, newId := range mapping {
+            imported[dataType][strconv.FormatInt(oldId, 10)] = newId
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]any{ "ids": imported })
+}
+
+// deletes the session's account. everything the user owns or authored goes to the trash
+// at once and their sessions end, then the account is purged once the trash retention
+// passes. signing in again before then restores it
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    removed, err := s.db.DeleteAccount(ownerId)
+    if err != nil {
+        log.Println("Could not delete account:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    revokeSessions(ownerId)
+    log.Printf("Deleted account %d, %d records in trash\n", ownerId, removed)
+    s.auditAccount(r.Context(), ownerId, auditDeleteAccount)
+
+    s.clearSessionCookie(w, r)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]any{
+        "records": removed,
+        "purge_after": time.Now().Add(s.trashRetention).UTC(),
+    })
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+    "net/http"
+    "strings"
+    "fmt"
+    "log"
+
+    "github.com/gorilla/mux"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// checks col may be aggregated or grouped on by any session that can see the records
+// server_only columns never can, owner_only columns only on private types
+func aggregatable(metaData types.MetaData, col string) error {
+    for _, column := range store.GetColumns(metaData.GetType()) {
+        if column.Name != col {
+            continue
+        }
+        if column.Visibility == store.ServerOnly || (column.Visibility == store.OwnerOnly && !store.IsPrivate(metaData)) {
+            break
+        }
+        return nil
+    }
+    return fmt.Errorf("%s has no field %s", metaData.GetType().Name(), col)
+}
+
+// aggregates requested with aggregate=count,sum:version or aggregate=count&aggregate=max:created_at
+func aggregateParam(r *http.Request, metaData types.MetaData) ([]store.Aggregate, error) {
+    aggregates := make([]store.Aggregate, 0)
+    for _, param := range r.URL.Query()["aggregate"] {
+        for _, term := range strings.Split(param, ",") {
+            if term == "" {
+                continue
+            }
+            fn, col, _ := strings.Cut(term, ":")
+            if col != "" {
+                if err := aggregatable(metaData, col); err != nil {
+                    return nil, err
+                }
+            }
+            aggregates = append(aggregates, store.Aggregate{ Func: fn, Col: col })
+        }
+    }
+    if len(aggregates) == 0 {
+        return nil, fmt.Errorf("aggregate is required")
+    }
+    return aggregates, nil
+}
+
+// columns requested with groupBy=a,b
+func groupByParam(r *http.Request, metaData types.MetaData) ([]string, error) {
+    groupBy := make([]string, 0)
+    for _, param := range r.URL.Query()["groupBy"] {
+        for _, col := range strings.Split(param, ",") {
+            if col == "" {
+                continue
+            }
+            if err := aggregatable(metaData, col); err != nil {
+                return nil, err
+            }
+            groupBy = append(groupBy, col)
+        }
+    }
+    return groupBy, nil
+}
+
+// number of records matching the data type's queries
+func (s *Server) handleCount(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists {
+        log.Println("No metaData for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+
+    count := store.Aggregate{ Func: "count" }
+    rows, err := s.db.Aggregate(metaData, queriesFromParams(r, metaData), []store.Aggregate{count}, nil, ownerId)
+    if err != nil || len(rows) != 1 {
+        log.Println("Could not count data:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    s.writeCacheable(w, r, metaData, "", nil, rows[0])
+}
+
+// count, min, max, sum and avg over the records matching the data type's queries,
+// one row per distinct value of the groupBy columns
+func (s *Server) handleAggregate(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists {
+        log.Println("No metaData for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+
+    aggregates, err := aggregateParam(r, metaData)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    groupBy, err := groupByParam(r, metaData)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    rows, err := s.db.Aggregate(metaData, queriesFromParams(r, metaData), aggregates, groupBy, ownerId)
+    if err != nil {
+        log.Println("Could not aggregate data:", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    s.writeCacheable(w, r, metaData, "", nil, rows)
+}
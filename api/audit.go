@@ -0,0 +1,254 @@
+package api
+
+import (
+    "net/http"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "reflect"
+    "strconv"
+    "regexp"
+    "context"
+    "time"
+    "net"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// audit log actions
+const (
+    auditCreate = "create"
+    auditUpdate = "update"
+    auditDelete = "delete"
+    auditRestore = "restore"
+    auditPurge = "purge"
+    auditImport = "import"
+    auditLogin = "login"
+    auditLogout = "logout"
+    auditDeleteAccount = "delete_account"
+    auditRestoreAccount = "restore_account"
+    auditSetQuotas = "set_quotas"
+)
+
+const (
+    requestIdHeader = "X-Request-Id"
+    defaultAuditLimit = 100
+    maxAuditLimit = 1000
+)
+
+// client supplied request ids are kept when they look like one
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// the request id and client ip, carried in the request context for the audit log
+type requestInfo struct {
+    id string
+    ip string
+}
+
+const requestInfoKey contextKey = "requestInfo"
+
+func clientIp(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// tags every request with an id, echoed in the X-Request-Id response header
+func withRequestId(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(requestIdHeader)
+        if !requestIdPattern.MatchString(id) {
+            b := make([]byte, 16)
+            rand.Read(b)
+            id = hex.EncodeToString(b)
+        }
+        w.Header().Set(requestIdHeader, id)
+        ctx := context.WithValue(r.Context(), requestInfoKey, requestInfo{ id: id, ip: clientIp(r) })
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// the stored record at id, nil when there is none
+func (s *Server) stored(metaData types.MetaData, id int64, ownerId int64) types.DataType {
+    data, err := s.db.Get(metaData, id, ownerId)
+    if err != nil {
+        return nil
+    }
+    return data
+}
+
+// fields that differ between two documents, as {"field": {"before": ..., "after": ...}}
+func auditDiff(before map[string]any, after map[string]any) map[string]any {
+    diff := make(map[string]any)
+    for key, value := range before {
+        if other, exists := after[key]; !exists || !reflect.DeepEqual(value, other) {
+            change := map[string]any{ "before": value }
+            if exists {
+                change["after"] = other
+            }
+            diff[key] = change
+        }
+    }
+    for key, value := range after {
+        if _, exists := before[key]; !exists {
+            diff[key] = map[string]any{ "after": value }
+        }
+    }
+    return diff
+}
+
+// as the record's writer sees it, nil for no record
+func auditDocument(record types.DataType) (map[string]any, error) {
+    if record == nil {
+        return nil, nil
+    }
+    writerId, _ := store.GetWriterId(record)
+    return redact(record, writerId)
+}
+
+// records a write of a record, before is nil for creates and after for hard deletes
+func (s *Server) audit(ctx context.Context, actorId int64, action string, before types.DataType, after types.DataType) {
+    record := after
+    if record == nil {
+        record = before
+    }
+    if record == nil {
+        return
+    }
+    beforeDoc, err := auditDocument(before)
+    if err != nil {
+        log.Println("Could not audit write:", err)
+        return
+    }
+    afterDoc, err := auditDocument(after)
+    if err != nil {
+        log.Println("Could not audit write:", err)
+        return
+    }
+    subjectId, _ := store.GetWriterId(record)
+    s.appendAudit(ctx, store.AuditEntry{
+        ActorId: actorId,
+        SubjectId: subjectId,
+        Action: action,
+        DataType: record.TypeString(),
+        RecordId: store.GetId(record),
+        Diff: auditDiff(beforeDoc, afterDoc),
+    })
+}
+
+// records an action on a user's account or session
+func (s *Server) auditAccount(ctx context.Context, userId int64, action string) {
+    s.appendAudit(ctx, store.AuditEntry{
+        ActorId: userId,
+        SubjectId: userId,
+        Action: action,
+        DataType: types.User{}.TypeString(),
+        RecordId: userId,
+    })
+}
+
+// the write has already happened, so a failure to record it is only logged
+func (s *Server) appendAudit(ctx context.Context, entry store.AuditEntry) {
+    entry.At = time.Now().UTC()
+    if info, ok := ctx.Value(requestInfoKey).(requestInfo); ok {
+        entry.Ip = info.ip
+        entry.RequestId = info.id
+    }
+    if err := s.db.AppendAudit(entry); err != nil {
+        log.Printf("Could not append to audit log: %v %+v\n", err, entry)
+    }
+}
+
+func (s *Server) isAdmin(ownerId int64) bool {
+    return s.admins[ownerId]
+}
+
+// int64 query param, 0 when absent
+func int64Param(r *http.Request, name string) (int64, error) {
+    param := r.URL.Query().Get(name)
+    if param == "" {
+        return 0, nil
+    }
+    return strconv.ParseInt(param, 10, 64)
+}
+
+// RFC3339 query param, the zero time when absent
+func timeParam(r *http.Request, name string) (time.Time, error) {
+    param := r.URL.Query().Get(name)
+    if param == "" {
+        return time.Time{}, nil
+    }
+    return time.Parse(time.RFC3339, param)
+}
+
+func auditFilterParams(r *http.Request) (store.AuditFilter, error) {
+    var filter store.AuditFilter
+    var err error
+    if filter.ActorId, err = int64Param(r, "actor"); err != nil {
+        return filter, err
+    }
+    if filter.SubjectId, err = int64Param(r, "user"); err != nil {
+        return filter, err
+    }
+    if filter.RecordId, err = int64Param(r, "id"); err != nil {
+        return filter, err
+    }
+    if filter.BeforeId, err = int64Param(r, "before"); err != nil {
+        return filter, err
+    }
+    if filter.Since, err = timeParam(r, "since"); err != nil {
+        return filter, err
+    }
+    if filter.Until, err = timeParam(r, "until"); err != nil {
+        return filter, err
+    }
+    filter.Action = r.URL.Query().Get("action")
+    filter.DataType = r.URL.Query().Get("type")
+    filter.Limit = defaultAuditLimit
+    if param := r.URL.Query().Get("limit"); param != "" {
+        filter.Limit, err = strconv.Atoi(param)
+        if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+            return filter, strconv.ErrRange
+        }
+    }
+    return filter, nil
+}
+
+// audit log entries newest first, page with before=<last id>
+// admins may read every entry, other users only those about their own account and records
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    filter, err := auditFilterParams(r)
+    if err != nil {
+        log.Println("Invalid audit query:", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    if !s.isAdmin(ownerId) {
+        if filter.SubjectId != 0 && filter.SubjectId != ownerId {
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
+        filter.SubjectId = ownerId
+    }
+
+    entries, err := s.db.GetAudit(filter)
+    if err != nil {
+        log.Println("Could not read audit log:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, no-store")
+    json.NewEncoder(w).Encode(entries)
+}
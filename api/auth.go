@@ -12,14 +12,13 @@ import (
     "encoding/base64"
     "encoding/json"
     "errors"
+    "sync"
 
     "golang.org/x/oauth2"
     "golang.org/x/oauth2/google"
 
-    "github.com/jackc/pgx/v5"
-
-    "github.com/reshane/glonk/types"
     "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
 )
 
 // session struct
@@ -27,23 +26,26 @@ type session struct {
     userId string
     ownerId int64
     expiry time.Time
+    // echoed by clients in the X-CSRF-Token header
+    csrfToken string
 }
 
 // google user response object
 type UserInfo struct {
-    Id string `json"id"`
-    Email string `json"email"`
-    VerifiedEmail bool `json"verified_email"`
-    Name string `json"name"`
-    GivenName string `json"given_name"`
-    FamilyName string `json"family_name"`
-    Picture string `json"picture"`
-    Locale string `json"locale"`
+    Id string `json:"id"`
+    Email string `json:"email"`
+    VerifiedEmail bool `json:"verified_email"`
+    Name string `json:"name"`
+    GivenName string `json:"given_name"`
+    FamilyName string `json:"family_name"`
+    Picture string `json:"picture"`
+    Locale string `json:"locale"`
 }
 
 var (
-    // sessions map
+    // sessions map, only accessed through the session functions below as handlers share it
     sessions = map[string]session{}
+    sessionsMu sync.RWMutex
 
     // google oauth config
     cfg = &oauth2.Config{
@@ -70,7 +72,7 @@ func isAuthorized(endpoint func(http.ResponseWriter, *http.Request)) http.Handle
             http.Error(w, "Bad Request", http.StatusBadRequest)
             return
         }
-        session, exists := sessions[sessionId.Value]
+        session, exists := getSession(sessionId.Value)
         if exists && session.expiry.After(time.Now()) {
             r.Header.Set("OwnerId", strconv.FormatInt(session.ownerId, 10))
             endpoint(w, r)
@@ -81,30 +83,81 @@ func isAuthorized(endpoint func(http.ResponseWriter, *http.Request)) http.Handle
     })
 }
 
-// logout - general across accounts
+// the ownerId of the request's session, when it has a live one
+func sessionOwnerId(r *http.Request) (int64, bool) {
+    sessionId, err := r.Cookie("session_id")
+    if err != nil {
+        return -1, false
+    }
+    session, exists := getSession(sessionId.Value)
+    if !exists || !session.expiry.After(time.Now()) {
+        return -1, false
+    }
+    return session.ownerId, true
+}
+
+func getSession(sessionId string) (session, bool) {
+    sessionsMu.RLock()
+    defer sessionsMu.RUnlock()
+    session, exists := sessions[sessionId]
+    return session, exists
+}
+
+func putSession(sessionId string, session session) {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    sessions[sessionId] = session
+}
+
+// removes a session, returning it when there was one
+func takeSession(sessionId string) (session, bool) {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    session, exists := sessions[sessionId]
+    delete(sessions, sessionId)
+    return session, exists
+}
+
+// ends every session of a user
+func revokeSessions(ownerId int64) {
+    sessionsMu.Lock()
+    defer sessionsMu.Unlock()
+    for sessionId, session := range sessions {
+        if session.ownerId == ownerId {
+            delete(sessions, sessionId)
+        }
+    }
+}
+
+func (s *Server) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+    http.SetCookie(w, s.newCookie(r, "session_id", "", time.Unix(0, 0)))
+    http.SetCookie(w, s.csrfTokenCookie(r, "", time.Unix(0, 0)))
+}
+
+// a random url safe token
+func newToken() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return base64.URLEncoding.EncodeToString(b)
+}
+
+// logout - general across accounts, POST only so other sites can't log users out with a link
 func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
     sessionId, err := r.Cookie("session_id")
     if err == nil {
-        _, exists := sessions[sessionId.Value]
+        session, exists := takeSession(sessionId.Value)
         if exists {
-            delete(sessions, sessionId.Value)
+            s.auditAccount(r.Context(), session.ownerId, auditLogout)
         }
     }
-    cookie := http.Cookie{
-        Name: "session_id",
-        Value: "",
-        Path: "/",
-        HttpOnly: true,
-        Expires: time.Unix(0, 0),
-    }
-    http.SetCookie(w, &cookie)
-    http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+    s.clearSessionCookie(w, r)
+    http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 
 // login endpoint & callback
 func (s *Server) googleLogin(w http.ResponseWriter, r *http.Request) {
-    oauthState := generateStateCookie(w)
+    oauthState := s.generateStateCookie(w, r)
     u := cfg.AuthCodeURL(oauthState)
     http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 }
@@ -120,6 +173,8 @@ func (s *Server) googleCallback(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // the state is single use
+    http.SetCookie(w, s.stateCookie(r, "", time.Unix(0, 0)))
     if r.FormValue("state") != oauthState.Value {
         log.Println("Invalid oauth google state")
         http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -134,7 +189,7 @@ func (s *Server) googleCallback(w http.ResponseWriter, r *http.Request) {
     }
 
     // redirect to user endpoint
-    retrievedUser, err := s.retreiveOrCreateUser(userInfo)
+    retrievedUser, err := s.retreiveOrCreateUser(r.Context(), userInfo)
     if err != nil {
         log.Println(err.Error())
         http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -142,63 +197,68 @@ func (s *Server) googleCallback(w http.ResponseWriter, r *http.Request) {
     }
 
     var expiration = time.Now().Add(20 * time.Minute)
-    b := make([]byte, 16)
-    rand.Read(b)
-    sessionId := base64.URLEncoding.EncodeToString(b)
-    cookie := http.Cookie{
-        Name: "session_id",
-        Value: sessionId,
-        Path: "/",
-        HttpOnly: true,
-        Expires: expiration,
-    }
-    http.SetCookie(w, &cookie)
-    sessions[sessionId] = session {
+    sessionId := newToken()
+    csrfToken := newToken()
+    http.SetCookie(w, s.newCookie(r, "session_id", sessionId, expiration))
+    http.SetCookie(w, s.csrfTokenCookie(r, csrfToken, expiration))
+    putSession(sessionId, session {
         userId: retrievedUser.Guid,
         ownerId: retrievedUser.ID,
         expiry: expiration,
-    }
+        csrfToken: csrfToken,
+    })
+    s.auditAccount(r.Context(), retrievedUser.ID, auditLogin)
 
     http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
-func (s *Server) retreiveOrCreateUser(userInfo *UserInfo) (*types.User, error) {
+func (s *Server) retreiveOrCreateUser(ctx context.Context, userInfo *UserInfo) (*types.User, error) {
     guid := userInfo.Id
-    user, err := s.db.GetByGuid(types.UserMeta, "google/" + guid)
+    newUser := types.User{
+        Guid: "google/" + guid,
+        Name: userInfo.Name,
+        Email: userInfo.Email,
+        Picture: userInfo.Picture,
+    }
+    // keyed on guid so concurrent first logins can't create duplicate users
+    user, created, err := s.db.Upsert(newUser, "guid")
     if err != nil {
-        if !errors.Is(err, pgx.ErrNoRows) && !errors.Is(err, store.NoRows{}) {
-            return nil, err
-        }
-
-        newUser := types.User{
-            Guid: "google/" + guid,
-            Name: userInfo.Name,
-            Email: userInfo.Email,
-            Picture: userInfo.Picture,
-        }
-        log.Println("Creating new user", newUser)
-        user, err = s.db.Create(newUser)
-        if err != nil {
-            log.Println("Error creating new user:", err.Error())
-            return nil, err
-        }
+        log.Println("Error retreiving or creating user:", err.Error())
+        return nil, err
+    }
+    if created {
+        log.Println("Created new user", user)
+        s.audit(ctx, store.GetId(user), auditCreate, nil, user)
     }
     retreivedUser := user.(types.User)
+    // signing in during the grace period cancels a pending account deletion
+    restored, err := s.db.RestoreAccount(retreivedUser.ID)
+    if err == nil {
+        log.Printf("Restored account %d and %d records\n", retreivedUser.ID, restored)
+        s.auditAccount(ctx, retreivedUser.ID, auditRestoreAccount)
+    } else if !errors.Is(err, store.NoRows{}) {
+        log.Println("Error restoring account:", err.Error())
+        return nil, err
+    }
     return &retreivedUser, nil
 }
 
-func generateStateCookie(w http.ResponseWriter) string {
+func (s *Server) generateStateCookie(w http.ResponseWriter, r *http.Request) string {
     var expiration = time.Now().Add(20 * time.Minute)
 
-    b := make([]byte, 16)
-    rand.Read(b)
-    state := base64.URLEncoding.EncodeToString(b)
-    cookie := http.Cookie{ Name: "oauthstate", Value: state, Expires: expiration }
-    http.SetCookie(w, &cookie)
+    state := newToken()
+    http.SetCookie(w, s.stateCookie(r, state, expiration))
 
     return state
 }
 
+// only sent back to the oauth callback
+func (s *Server) stateCookie(r *http.Request, state string, expiry time.Time) *http.Cookie {
+    cookie := s.newCookie(r, "oauthstate", state, expiry)
+    cookie.Path = "/auth/google"
+    return cookie
+}
+
 func getUserDataFromGoogle(code string) (*UserInfo, error) {
     token, err := cfg.Exchange(context.Background(), code)
     if err != nil {
@@ -0,0 +1,104 @@
+package api
+
+import (
+    "net/http"
+    "encoding/hex"
+    "crypto/sha256"
+    "bytes"
+    "strings"
+    "strconv"
+    "time"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// strong entity tag from the encoded response body
+func contentETag(body []byte) string {
+    sum := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// the record's updated_at, zero for no record or a type without one. collections get
+// no Last-Modified as a record deleted or leaving the filter doesn't move their newest
+// updated_at, they're validated by content ETag alone
+func lastModified(record types.DataType) time.Time {
+    if record == nil {
+        return time.Time{}
+    }
+    updatedAt, err := store.GetUpdatedAt(record)
+    if err != nil {
+        return time.Time{}
+    }
+    return updatedAt.Truncate(time.Second)
+}
+
+// RFC 9110 If-None-Match evaluation, uses weak comparison
+func noneMatch(header string, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" {
+            return false
+        }
+        if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+            return false
+        }
+    }
+    return true
+}
+
+// true if the client's cached copy is still fresh
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+    if header := r.Header.Get("If-None-Match"); header != "" {
+        return !noneMatch(header, etag)
+    }
+    if header := r.Header.Get("If-Modified-Since"); header != "" && !modified.IsZero() {
+        since, err := http.ParseTime(header)
+        if err != nil {
+            return false
+        }
+        return !modified.After(since)
+    }
+    return false
+}
+
+// private types are only ever cached by the requesting browser,
+// public types may be cached by shared caches for cacheMaxAge.
+// expanded responses may embed private records so are always private
+func (s *Server) cacheControl(r *http.Request, metaData types.MetaData) string {
+    if store.IsPrivate(metaData) || r.URL.Query().Has("expand") {
+        return "private, no-cache"
+    }
+    return "public, max-age=" + strconv.Itoa(int(s.cacheMaxAge.Seconds())) + ", must-revalidate"
+}
+
+// writes a GET response with validators, answering 304 when the client is up to date.
+// record is the single record responded with, nil for collections
+func (s *Server) writeCacheable(w http.ResponseWriter, r *http.Request, metaData types.MetaData, etag string, record types.DataType, data any) {
+    f := responseFormat(r)
+    var body bytes.Buffer
+    if err := f.encode(&body, metaData, data); err != nil {
+        log.Println("Could not encode response:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    if etag == "" {
+        etag = contentETag(body.Bytes())
+    }
+    modified := lastModified(record)
+
+    w.Header().Set("ETag", etag)
+    if !modified.IsZero() {
+        w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+    }
+    w.Header().Set("Cache-Control", s.cacheControl(r, metaData))
+    w.Header().Add("Vary", "Cookie, Accept")
+
+    if notModified(r, etag, modified) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("Content-Type", f.contentType)
+    w.Write(body.Bytes())
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+    "net/http"
+    "net/url"
+    "crypto/subtle"
+    "slices"
+    "time"
+    "log"
+)
+
+const (
+    csrfCookie = "csrf_token"
+    csrfHeader = "X-CSRF-Token"
+)
+
+// cookies set by the server are SameSite=Lax - sent on top level navigations, like the
+// oauth callback, but not on cross site subresource requests - and Secure over https
+func (s *Server) newCookie(r *http.Request, name string, value string, expiry time.Time) *http.Cookie {
+    return &http.Cookie{
+        Name: name,
+        Value: value,
+        Path: "/",
+        Expires: expiry,
+        HttpOnly: true,
+        Secure: s.secureCookies || r.TLS != nil,
+        SameSite: http.SameSiteLaxMode,
+    }
+}
+
+// the session's csrf token, readable by the frontend so it can echo it in the X-CSRF-Token header
+func (s *Server) csrfTokenCookie(r *http.Request, token string, expiry time.Time) *http.Cookie {
+    cookie := s.newCookie(r, csrfCookie, token, expiry)
+    cookie.HttpOnly = false
+    cookie.SameSite = http.SameSiteStrictMode
+    return cookie
+}
+
+func isSafeMethod(method string) bool {
+    return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// rejects state changing requests made with the session cookie from other sites.
+// browsers say where a request came from in Sec-Fetch-Site, or failing that Origin,
+// clients sending neither must echo the session's csrf token in X-CSRF-Token
+func (s *Server) csrf(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if isSafeMethod(r.Method) || !s.crossSite(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        log.Printf("Blocked cross site %s %s from %s\n", r.Method, r.URL.Path, r.Header.Get("Origin"))
+        http.Error(w, "Forbidden", http.StatusForbidden)
+    })
+}
+
+func (s *Server) crossSite(r *http.Request) bool {
+    sessionId, err := r.Cookie("session_id")
+    if err != nil {
+        // without a session there is nothing to forge
+        return false
+    }
+    site := r.Header.Get("Sec-Fetch-Site")
+    if site == "same-origin" || site == "none" {
+        return false
+    }
+    if origin := r.Header.Get("Origin"); origin != "" {
+        return !s.trustedOrigin(r, origin)
+    }
+    if site != "" {
+        return true
+    }
+    session, exists := getSession(sessionId.Value)
+    token := r.Header.Get(csrfHeader)
+    return !exists || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(session.csrfToken)) != 1
+}
+
+// origins allowed to make state changing requests, the server's own and those the cors
+// policy sends credentials to
+func (s *Server) trustedOrigin(r *http.Request, origin string) bool {
+    if s.corsPolicy.Credentials && slices.Contains(s.corsPolicy.Origins, origin) {
+        return true
+    }
+    u, err := url.Parse(origin)
+    return err == nil && u.Host == r.Host
+}
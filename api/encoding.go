@@ -0,0 +1,453 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "encoding/csv"
+    "reflect"
+    "strings"
+    "strconv"
+    "errors"
+    "sort"
+    "mime"
+    "fmt"
+    "io"
+    "log"
+
+    "github.com/vmihailenco/msgpack/v5"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// a response representation, encode is given a record document or a list of them
+type format struct {
+    // short name, distinguishing the format in entity tags
+    name string
+    contentType string
+    encode func(io.Writer, types.MetaData, any) error
+    // writes records one at a time given the columns, nil for formats only written whole
+    stream func(io.Writer, []string) recordWriter
+}
+
+type recordWriter interface {
+    Write(map[string]any) error
+    Close() error
+}
+
+var (
+    jsonFormat = &format{ "json", "application/json", encodeJson, nil }
+    ndjsonFormat = &format{ "ndjson", "application/x-ndjson", encodeNdjson, newNdjsonWriter }
+    csvFormat = &format{ "csv", "text/csv; charset=utf-8", encodeCsv, newCsvWriter }
+    msgpackFormat = &format{ "msgpack", "application/msgpack", encodeMsgpack, nil }
+)
+
+// media types accepted in Accept and Content-Type headers
+var formats = map[string]*format {
+    "application/json": jsonFormat,
+    "application/x-ndjson": ndjsonFormat,
+    "application/ndjson": ndjsonFormat,
+    "application/jsonl": ndjsonFormat,
+    "text/csv": csvFormat,
+    "application/msgpack": msgpackFormat,
+    "application/vnd.msgpack": msgpackFormat,
+    "application/x-msgpack": msgpackFormat,
+    "*/*": jsonFormat,
+    "application/*": jsonFormat,
+    "text/*": csvFormat,
+}
+
+var errUnsupportedMediaType = errors.New("Unsupported media type")
+
+// picks the response format from the Accept header, json when there is none
+func negotiate(r *http.Request) (*format, bool) {
+    accept := r.Header.Get("Accept")
+    if accept == "" {
+        return jsonFormat, true
+    }
+    var best *format
+    bestQ := 0.0
+    for _, part := range strings.Split(accept, ",") {
+        mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+        if err != nil {
+            continue
+        }
+        q := 1.0
+        if qParam, exists := params["q"]; exists {
+            q, err = strconv.ParseFloat(qParam, 64)
+            if err != nil {
+                continue
+            }
+        }
+        f, exists := formats[mediaType]
+        if exists && q > bestQ {
+            best = f
+            bestQ = q
+        }
+    }
+    return best, best != nil
+}
+
+// responds 406 before running endpoint when no supported format is acceptable
+func acceptable(endpoint func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if _, ok := negotiate(r); !ok {
+            http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+            return
+        }
+        endpoint(w, r)
+    }
+}
+
+func responseFormat(r *http.Request) *format {
+    f, ok := negotiate(r)
+    if !ok {
+        return jsonFormat
+    }
+    return f
+}
+
+// documents in data, a record or list of records
+func documents(data any) []map[string]any {
+    switch v := data.(type) {
+    case []map[string]any:
+        return v
+    case map[string]any:
+        return []map[string]any{v}
+    }
+    return nil
+}
+
+func encodeJson(w io.Writer, metaData types.MetaData, data any) error {
+    return json.NewEncoder(w).Encode(data)
+}
+
+// a json document per line, flushed as it's written
+type ndjsonWriter struct {
+    encoder *json.Encoder
+    flusher http.Flusher
+}
+
+func newNdjsonWriter(w io.Writer, columns []string) recordWriter {
+    flusher, _ := w.(http.Flusher)
+    return &ndjsonWriter{ encoder: json.NewEncoder(w), flusher: flusher }
+}
+
+func (nw *ndjsonWriter) Write(doc map[string]any) error {
+    if err := nw.encoder.Encode(doc); err != nil {
+        return err
+    }
+    if nw.flusher != nil {
+        nw.flusher.Flush()
+    }
+    return nil
+}
+
+func (nw *ndjsonWriter) Close() error {
+    return nil
+}
+
+func encodeNdjson(w io.Writer, metaData types.MetaData, data any) error {
+    return writeAll(newNdjsonWriter(w, nil), documents(data))
+}
+
+func writeAll(rw recordWriter, docs []map[string]any) error {
+    for _, doc := range docs {
+        if err := rw.Write(doc); err != nil {
+            return err
+        }
+    }
+    return rw.Close()
+}
+
+// csv columns for docs - the data type's glonk columns in struct order, then any other keys sorted
+func csvColumns(metaData types.MetaData, docs []map[string]any) []string {
+    present := make(map[string]bool)
+    for _, doc := range docs {
+        for key := range doc {
+            present[key] = true
+        }
+    }
+    columns := make([]string, 0)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if present[col.JsonName] {
+            columns = append(columns, col.JsonName)
+            delete(present, col.JsonName)
+        }
+    }
+    rest := make([]string, 0)
+    for key := range present {
+        rest = append(rest, key)
+    }
+    sort.Strings(rest)
+    return append(columns, rest...)
+}
+
+func csvValue(value any) (string, error) {
+    switch v := value.(type) {
+    case nil:
+        return "", nil
+    case string:
+        return v, nil
+    case json.Number:
+        return v.String(), nil
+    case bool:
+        return strconv.FormatBool(v), nil
+    case int64:
+        return strconv.FormatInt(v, 10), nil
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64), nil
+    }
+    // embedded records and json columns are written as json
+    encoded, err := json.Marshal(value)
+    return string(encoded), err
+}
+
+// a header row of json field names, then a row per record
+type csvWriter struct {
+    writer *csv.Writer
+    columns []string
+}
+
+func newCsvWriter(w io.Writer, columns []string) recordWriter {
+    writer := csv.NewWriter(w)
+    writer.Write(columns)
+    return &csvWriter{ writer: writer, columns: columns }
+}
+
+func (cw *csvWriter) Write(doc map[string]any) error {
+    row := make([]string, len(cw.columns))
+    for i, col := range cw.columns {
+        value, err := csvValue(doc[col])
+        if err != nil {
+            return err
+        }
+        row[i] = value
+    }
+    return cw.writer.Write(row)
+}
+
+func (cw *csvWriter) Close() error {
+    cw.writer.Flush()
+    return cw.writer.Error()
+}
+
+func encodeCsv(w io.Writer, metaData types.MetaData, data any) error {
+    docs := documents(data)
+    return writeAll(newCsvWriter(w, csvColumns(metaData, docs)), docs)
+}
+
+// replaces json.Numbers with int64 or float64 so they encode as msgpack numbers
+func plainValue(value any) any {
+    switch v := value.(type) {
+    case json.Number:
+        if i, err := v.Int64(); err == nil {
+            return i
+        }
+        f, _ := v.Float64()
+        return f
+    case map[string]any:
+        plain := make(map[string]any, len(v))
+        for key, item := range v {
+            plain[key] = plainValue(item)
+        }
+        return plain
+    case []map[string]any:
+        plain := make([]any, 0, len(v))
+        for _, item := range v {
+            plain = append(plain, plainValue(item))
+        }
+        return plain
+    case []any:
+        plain := make([]any, 0, len(v))
+        for _, item := range v {
+            plain = append(plain, plainValue(item))
+        }
+        return plain
+    }
+    return value
+}
+
+// the json document encoded as msgpack, times are RFC 3339 strings as in json
+func encodeMsgpack(w io.Writer, metaData types.MetaData, data any) error {
+    encoder := msgpack.NewEncoder(w)
+    encoder.SetSortMapKeys(true)
+    return encoder.Encode(plainValue(data))
+}
+
+// decodes a request body by its Content-Type, json goes through the data type's own Decoder
+func decodeBody(metaData types.MetaData, r *http.Request) (types.DataType, error) {
+    contentType := r.Header.Get("Content-Type")
+    if contentType == "" {
+        return metaData.GetDecoder()(r)
+    }
+    mediaType, _, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        return nil, err
+    }
+    switch formats[mediaType] {
+    case jsonFormat, ndjsonFormat:
+        // the first line of ndjson is a json document
+        return metaData.GetDecoder()(r)
+    case msgpackFormat:
+        var doc map[string]any
+        if err := msgpack.NewDecoder(r.Body).Decode(&doc); err != nil {
+            return nil, err
+        }
+        return fromDocument(metaData, doc)
+    case csvFormat:
+        return decodeCsv(metaData, r.Body)
+    }
+    return nil, errUnsupportedMediaType
+}
+
+// a header row of json field names and a single record row
+func decodeCsv(metaData types.MetaData, body io.Reader) (types.DataType, error) {
+    reader := csv.NewReader(body)
+    header, err := reader.Read()
+    if err != nil {
+        return nil, err
+    }
+    row, err := reader.Read()
+    if err != nil {
+        return nil, err
+    }
+    columns := make(map[string]store.Column)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        columns[col.JsonName] = col
+    }
+    doc := make(map[string]any)
+    for i, name := range header {
+        col, exists := columns[name]
+        if !exists {
+            return nil, fmt.Errorf("%s has no field %s", metaData.GetType().Name(), name)
+        }
+        value, err := csvField(col.Field.Type, row[i])
+        if err != nil {
+            return nil, fmt.Errorf("Invalid value for %s: %v", name, err)
+        }
+        doc[name] = value
+    }
+    return fromDocument(metaData, doc)
+}
+
+// the json value for a csv cell of a field of type typ, empty cells are null
+func csvField(typ reflect.Type, cell string) (any, error) {
+    if cell == "" && typ.Kind() != reflect.String {
+        return nil, nil
+    }
+    if typ.Kind() == reflect.Pointer {
+        typ = typ.Elem()
+    }
+    if typ == timeType {
+        return cell, nil
+    }
+    switch typ.Kind() {
+    case reflect.Bool:
+        return strconv.ParseBool(cell)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+        reflect.Float32, reflect.Float64:
+        if _, err := strconv.ParseFloat(cell, 64); err != nil {
+            return nil, err
+        }
+        return json.Number(cell), nil
+    case reflect.String:
+        return cell, nil
+    case reflect.Slice:
+        if typ.Elem().Kind() == reflect.Uint8 {
+            return cell, nil
+        }
+    }
+    if !json.Valid([]byte(cell)) {
+        return nil, errors.New("not valid json")
+    }
+    return json.RawMessage(cell), nil
+}
+
+// decodes a write's body, responding 415 or 400 when it can't be
+func decodeWrite(w http.ResponseWriter, r *http.Request, metaData types.MetaData) (types.DataType, bool) {
+    data, err := decodeBody(metaData, r)
+    if err != nil {
+        log.Println(err)
+        if errors.Is(err, errUnsupportedMediaType) {
+            http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+            return nil, false
+        }
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return nil, false
+    }
+    return data, true
+}
+
+// writes a response in the negotiated format
+func writeFormatted(w http.ResponseWriter, r *http.Request, status int, metaData types.MetaData, data any) {
+    f := responseFormat(r)
+    w.Header().Set("Content-Type", f.contentType)
+    w.Header().Add("Vary", "Accept")
+    w.WriteHeader(status)
+    if err := f.encode(w, metaData, data); err != nil {
+        log.Println("Could not encode response:", err)
+    }
+}
+
+// columns of a streamed response - the visible columns, or the id and requested fields
+func streamColumns(metaData types.MetaData, fields []string) []string {
+    requested := make(map[string]bool)
+    for _, field := range fields {
+        requested[field] = true
+    }
+    columns := make([]string, 0)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if col.Visibility == store.ServerOnly {
+            continue
+        }
+        if len(fields) == 0 || requested[col.Name] || col.Name == "id" {
+            columns = append(columns, col.JsonName)
+        }
+    }
+    return columns
+}
+
+// writes records a row at a time as the store reads them, so memory stays flat however many match.
+// streamed responses aren't buffered, so carry no validators
+func (s *Server) streamRecords(w http.ResponseWriter, r *http.Request, f *format, metaData types.MetaData, queries []types.Query, fields []string, ownerId int64) {
+    var rw recordWriter
+    start := func() {
+        w.Header().Set("Content-Type", f.contentType)
+        w.Header().Set("Cache-Control", s.cacheControl(r, metaData))
+        w.Header().Add("Vary", "Cookie, Accept")
+        rw = f.stream(w, streamColumns(metaData, fields))
+    }
+    for record, err := range s.db.StreamByQueries(metaData, queries, ownerId) {
+        if err != nil {
+            log.Println("Could not find data:", err)
+            if rw == nil {
+                http.Error(w, "Not Found", http.StatusNotFound)
+            }
+            // otherwise the response is already underway and is cut short
+            return
+        }
+        doc, err := redact(record, ownerId)
+        if err != nil {
+            log.Println("Could not encode response:", err)
+            return
+        }
+        if len(fields) > 0 {
+            project([]map[string]any{doc}, metaData, fields, nil)
+        }
+        if rw == nil {
+            start()
+        }
+        if err := rw.Write(doc); err != nil {
+            log.Println("Could not write response:", err)
+            return
+        }
+    }
+    if rw == nil {
+        start()
+    }
+    if err := rw.Close(); err != nil {
+        log.Println("Could not write response:", err)
+    }
+}
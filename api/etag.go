@@ -0,0 +1,92 @@
+package api
+
+import (
+    "net/http"
+    "strings"
+    "strconv"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// strong entity tag for types with a version column, e.g. "3-json-owner". the same version
+// is a different representation in each response format and for the owner, who sees
+// owner_only fields, than for everyone else
+func versionETag(r *http.Request, data types.DataType, viewerId int64) (string, bool) {
+    version, err := store.GetVersion(data)
+    if err != nil {
+        return "", false
+    }
+    view := "public"
+    if writerId, err := store.GetWriterId(data); err == nil && writerId == viewerId {
+        view = "owner"
+    }
+    return `"` + strconv.FormatInt(version, 10) + "-" + responseFormat(r).name + "-" + view + `"`, true
+}
+
+// the version a version entity tag was made from
+func etagVersion(etag string) string {
+    version, _, _ := strings.Cut(strings.Trim(etag, `"`), "-")
+    return version
+}
+
+// RFC 9110 If-Match evaluation against the current entity tag. writes are to the record
+// rather than a representation of it, so tags of any format or view match by version
+func etagMatches(header string, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" {
+            return true
+        }
+        // If-Match uses strong comparison so weak tags never match
+        if strings.HasPrefix(candidate, "W/") {
+            continue
+        }
+        if etag != "" && etagVersion(candidate) == etagVersion(etag) {
+            return true
+        }
+    }
+    return false
+}
+
+// checks an If-Match header against a record already read, responding 412 when it doesn't match
+func ifMatches(w http.ResponseWriter, r *http.Request, current types.DataType, ownerId int64) bool {
+    header := r.Header.Get("If-Match")
+    if header == "" {
+        return true
+    }
+    etag, _ := versionETag(r, current, ownerId)
+    if !etagMatches(header, etag) {
+        log.Printf("If-Match %s does not match current etag %s\n", header, etag)
+        w.Header().Set("ETag", etag)
+        http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+        return false
+    }
+    return true
+}
+
+// checks an If-Match header against the stored record
+// returns the stored version so the write can be made conditional on it,
+// 0 if there is no If-Match header or the type is unversioned
+func (s *Server) checkIfMatch(w http.ResponseWriter, r *http.Request, metaData types.MetaData, id int64, ownerId int64) (int64, bool) {
+    header := r.Header.Get("If-Match")
+    if header == "" {
+        return 0, true
+    }
+
+    current, err := s.db.Get(metaData, id, ownerId)
+    if err != nil {
+        log.Println("Could not find data for If-Match:", err)
+        http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+        return 0, false
+    }
+    if !ifMatches(w, r, current, ownerId) {
+        return 0, false
+    }
+    version, err := store.GetVersion(current)
+    if err != nil {
+        return 0, true
+    }
+    return version, true
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+    "net/http"
+    "strings"
+    "fmt"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// relation names requested with expand=a,b or expand=a&expand=b
+func expandParam(r *http.Request) []string {
+    names := make([]string, 0)
+    for _, param := range r.URL.Query()["expand"] {
+        for _, name := range strings.Split(param, ",") {
+            if name != "" {
+                names = append(names, name)
+            }
+        }
+    }
+    return names
+}
+
+func int64Column(record types.DataType, col string) (int64, error) {
+    val, err := store.GetColumnValue(record, col)
+    if err != nil {
+        return 0, err
+    }
+    id, ok := val.(int64)
+    if !ok {
+        return 0, fmt.Errorf("relation column %s must be int64", col)
+    }
+    return id, nil
+}
+
+// records related through relation to the given keys
+func (s *Server) related(relation store.Relation, targetMeta types.MetaData, keys []int64, ownerId int64) ([]types.DataType, error) {
+    queries := []types.Query{ types.NewById(relation.ForeignCol, keys) }
+    if relation.Kind == "belongs_to" {
+        return s.db.GetReferenced(targetMeta, queries)
+    }
+    return s.db.GetByQueries(targetMeta, queries, ownerId)
+}
+
+// embeds related records into each record's json document
+// related records are batch loaded through the store and redacted so the session's visibility applies to them too.
+// has_many relations only load the session's own records, belongs_to targets are loaded whoever owns them
+// so e.g. a post's author shows with owner_only fields redacted
+func (s *Server) expand(metaData types.MetaData, records []types.DataType, docs []map[string]any, names []string, ownerId int64) error {
+    relations, err := store.GetRelations(metaData.GetType())
+    if err != nil {
+        return err
+    }
+    byName := make(map[string]store.Relation)
+    for _, relation := range relations {
+        byName[relation.Name] = relation
+    }
+
+    for _, name := range names {
+        relation, exists := byName[name]
+        if !exists {
+            return fmt.Errorf("%s has no relation %s", metaData.GetType().Name(), name)
+        }
+        targetMeta, exists := types.MetaDataMap[relation.Target]
+        if !exists {
+            return fmt.Errorf("relation %s references unknown data type %s", name, relation.Target)
+        }
+
+        keys := make([]int64, 0)
+        seen := make(map[int64]bool)
+        for _, record := range records {
+            key, err := int64Column(record, relation.LocalCol)
+            if err != nil {
+                return err
+            }
+            if !seen[key] {
+                seen[key] = true
+                keys = append(keys, key)
+            }
+        }
+
+        related := make(map[int64][]map[string]any)
+        if len(keys) > 0 {
+            found, err := s.related(relation, targetMeta, keys, ownerId)
+            if err != nil {
+                return err
+            }
+            for _, f := range found {
+                key, err := int64Column(f, relation.ForeignCol)
+                if err != nil {
+                    return err
+                }
+                doc, err := redact(f, ownerId)
+                if err != nil {
+                    return err
+                }
+                related[key] = append(related[key], doc)
+            }
+        }
+
+        for i, record := range records {
+            key, _ := int64Column(record, relation.LocalCol)
+            if relation.Kind == "belongs_to" {
+                if matches := related[key]; len(matches) > 0 {
+                    docs[i][name] = matches[0]
+                } else {
+                    docs[i][name] = nil
+                }
+                continue
+            }
+            matches := related[key]
+            if matches == nil {
+                matches = []map[string]any{}
+            }
+            docs[i][name] = matches
+        }
+    }
+    return nil
+}
@@ -0,0 +1,493 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "context"
+    "reflect"
+    "strings"
+    "strconv"
+    "errors"
+    "time"
+    "log"
+
+    "github.com/graphql-go/graphql"
+    "github.com/graphql-go/graphql/language/ast"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+type contextKey string
+
+const ownerIdKey contextKey = "ownerId"
+
+func ownerIdFromContext(ctx context.Context) (int64, error) {
+    ownerId, ok := ctx.Value(ownerIdKey).(int64)
+    if !ok {
+        return -1, errors.New("No session ownerId in context")
+    }
+    return ownerId, nil
+}
+
+// a record resolved by graphql, fields resolve from the redacted document
+// and relations from the record itself
+type graphqlRecord struct {
+    record types.DataType
+    doc map[string]any
+}
+
+func newGraphqlRecord(record types.DataType, ownerId int64) (*graphqlRecord, error) {
+    doc, err := redact(record, ownerId)
+    if err != nil {
+        return nil, err
+    }
+    return &graphqlRecord{ record: record, doc: doc }, nil
+}
+
+func newGraphqlRecords(records []types.DataType, ownerId int64) ([]*graphqlRecord, error) {
+    resolved := make([]*graphqlRecord, 0, len(records))
+    for _, record := range records {
+        r, err := newGraphqlRecord(record, ownerId)
+        if err != nil {
+            return nil, err
+        }
+        resolved = append(resolved, r)
+    }
+    return resolved, nil
+}
+
+// json columns, and anything else without a matching graphql scalar, pass through as json
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+    Name: "JSON",
+    Description: "Arbitrary JSON value",
+    Serialize: func(value any) any {
+        return value
+    },
+    ParseValue: func(value any) any {
+        return value
+    },
+    ParseLiteral: astValue,
+})
+
+func astValue(valueAST ast.Value) any {
+    switch v := valueAST.(type) {
+    case *ast.StringValue:
+        return v.Value
+    case *ast.BooleanValue:
+        return v.Value
+    case *ast.IntValue:
+        return json.Number(v.Value)
+    case *ast.FloatValue:
+        return json.Number(v.Value)
+    case *ast.EnumValue:
+        return v.Value
+    case *ast.ListValue:
+        list := make([]any, 0, len(v.Values))
+        for _, item := range v.Values {
+            list = append(list, astValue(item))
+        }
+        return list
+    case *ast.ObjectValue:
+        obj := make(map[string]any)
+        for _, field := range v.Fields {
+            obj[field.Name.Value] = astValue(field.Value)
+        }
+        return obj
+    }
+    return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// graphql scalar for a field's go type
+func graphqlScalar(typ reflect.Type) *graphql.Scalar {
+    if typ.Kind() == reflect.Pointer {
+        typ = typ.Elem()
+    }
+    if typ == timeType {
+        return graphql.DateTime
+    }
+    switch typ.Kind() {
+    case reflect.Bool:
+        return graphql.Boolean
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return graphql.Int
+    case reflect.Float32, reflect.Float64:
+        return graphql.Float
+    case reflect.String:
+        return graphql.String
+    case reflect.Slice:
+        // []byte is encoded as a base64 string
+        if typ.Elem().Kind() == reflect.Uint8 {
+            return graphql.String
+        }
+    }
+    return jsonScalar
+}
+
+// resolves a column from the record's redacted document, redacted fields resolve to null
+func columnResolver(col store.Column) graphql.FieldResolveFn {
+    scalar := graphqlScalar(col.Field.Type)
+    return func(p graphql.ResolveParams) (any, error) {
+        source, ok := p.Source.(*graphqlRecord)
+        if !ok {
+            return nil, nil
+        }
+        value := source.doc[col.JsonName]
+        switch v := value.(type) {
+        case json.Number:
+            if scalar == jsonScalar {
+                return v, nil
+            }
+            return v.String(), nil
+        case string:
+            if scalar == graphql.DateTime {
+                return time.Parse(time.RFC3339Nano, v)
+            }
+        }
+        return value, nil
+    }
+}
+
+// resolves a belongs_to or has_many relation through the store, redacted so the session's visibility applies
+func (s *Server) relationResolver(relation store.Relation, targetMeta types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        source, ok := p.Source.(*graphqlRecord)
+        if !ok {
+            return nil, nil
+        }
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        key, err := int64Column(source.record, relation.LocalCol)
+        if err != nil {
+            return nil, err
+        }
+        found, err := s.related(relation, targetMeta, []int64{key}, ownerId)
+        if err != nil {
+            return nil, err
+        }
+        related, err := newGraphqlRecords(found, ownerId)
+        if err != nil {
+            return nil, err
+        }
+        if relation.Kind == "belongs_to" {
+            if len(related) == 0 {
+                return nil, nil
+            }
+            return related[0], nil
+        }
+        return related, nil
+    }
+}
+
+// graphql schema generated from types.MetaDataMap
+//  query: <dataType>(id) and <table>(<queries>) for each type
+//  mutation: create<Type>(input), update<Type>(input) and delete<Type>(id)
+// fields come from glonk columns, server_only columns are left out
+func (s *Server) graphqlSchema() (graphql.Schema, error) {
+    objects := make(map[string]*graphql.Object)
+    for dataType, metaData := range types.MetaDataMap {
+        typ := metaData.GetType()
+        objects[dataType] = graphql.NewObject(graphql.ObjectConfig{
+            Name: typ.Name(),
+            Fields: graphql.FieldsThunk(func() graphql.Fields {
+                fields := graphql.Fields{}
+                for _, col := range store.GetColumns(typ) {
+                    if col.Visibility == store.ServerOnly {
+                        continue
+                    }
+                    fields[col.JsonName] = &graphql.Field{
+                        Type: graphqlScalar(col.Field.Type),
+                        Resolve: columnResolver(col),
+                    }
+                }
+                relations, err := store.GetRelations(typ)
+                if err != nil {
+                    log.Println("Could not get relations for", typ.Name(), err)
+                    return fields
+                }
+                for _, relation := range relations {
+                    target, exists := objects[relation.Target]
+                    if !exists {
+                        continue
+                    }
+                    var fieldType graphql.Output = target
+                    if relation.Kind != "belongs_to" {
+                        fieldType = graphql.NewList(target)
+                    }
+                    fields[relation.Name] = &graphql.Field{
+                        Type: fieldType,
+                        Resolve: s.relationResolver(relation, types.MetaDataMap[relation.Target]),
+                    }
+                }
+                return fields
+            }),
+        })
+    }
+
+    queries := graphql.Fields{}
+    mutations := graphql.Fields{}
+    for dataType, metaData := range types.MetaDataMap {
+        object := objects[dataType]
+        queries[dataType] = &graphql.Field{
+            Type: object,
+            Args: graphql.FieldConfigArgument{
+                "id": &graphql.ArgumentConfig{ Type: graphql.NewNonNull(graphql.Int) },
+            },
+            Resolve: s.resolveGet(metaData),
+        }
+        listArgs := graphql.FieldConfigArgument{}
+        for name := range metaData.GetQueries() {
+            listArgs[name] = &graphql.ArgumentConfig{ Type: graphql.NewList(graphql.String) }
+        }
+        queries[metaData.TableName()] = &graphql.Field{
+            Type: graphql.NewList(object),
+            Args: listArgs,
+            Resolve: s.resolveList(metaData),
+        }
+
+        inputFields := graphql.InputObjectConfigFieldMap{}
+        for _, col := range store.GetColumns(metaData.GetType()) {
+            if col.Visibility == store.ServerOnly {
+                continue
+            }
+            inputFields[col.JsonName] = &graphql.InputObjectFieldConfig{ Type: graphqlScalar(col.Field.Type) }
+        }
+        input := graphql.NewInputObject(graphql.InputObjectConfig{
+            Name: object.Name() + "Input",
+            Fields: inputFields,
+        })
+        inputArgs := graphql.FieldConfigArgument{
+            "input": &graphql.ArgumentConfig{ Type: graphql.NewNonNull(input) },
+        }
+        mutations["create" + object.Name()] = &graphql.Field{
+            Type: object,
+            Args: inputArgs,
+            Resolve: s.resolveCreate(metaData),
+        }
+        mutations["update" + object.Name()] = &graphql.Field{
+            Type: object,
+            Args: inputArgs,
+            Resolve: s.resolveUpdate(metaData),
+        }
+        mutations["delete" + object.Name()] = &graphql.Field{
+            Type: object,
+            Args: graphql.FieldConfigArgument{
+                "id": &graphql.ArgumentConfig{ Type: graphql.NewNonNull(graphql.Int) },
+            },
+            Resolve: s.resolveDelete(metaData),
+        }
+    }
+
+    return graphql.NewSchema(graphql.SchemaConfig{
+        Query: graphql.NewObject(graphql.ObjectConfig{ Name: "Query", Fields: queries }),
+        Mutation: graphql.NewObject(graphql.ObjectConfig{ Name: "Mutation", Fields: mutations }),
+    })
+}
+
+func (s *Server) resolveGet(metaData types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        id, _ := p.Args["id"].(int)
+        found, err := s.db.Get(metaData, int64(id), ownerId)
+        if err != nil {
+            if errors.Is(err, store.NoRows{}) {
+                return nil, nil
+            }
+            return nil, err
+        }
+        return newGraphqlRecord(found, ownerId)
+    }
+}
+
+// list arguments are the data type's queries, given the values their query params would take
+func (s *Server) resolveList(metaData types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        builders := metaData.GetQueries()
+        queries := make([]types.Query, 0)
+        for name, arg := range p.Args {
+            builder, exists := builders[name]
+            if !exists {
+                continue
+            }
+            values := make([]string, 0)
+            args, _ := arg.([]any)
+            for _, value := range args {
+                if str, ok := value.(string); ok {
+                    values = append(values, str)
+                }
+            }
+            query, err := builder.Parser(builder.Field, values)
+            if err != nil {
+                return nil, errors.New("Invalid argument " + name + ": " + err.Error())
+            }
+            queries = append(queries, query)
+        }
+        found, err := s.db.GetByQueries(metaData, queries, ownerId)
+        if err != nil {
+            return nil, err
+        }
+        return newGraphqlRecords(found, ownerId)
+    }
+}
+
+// decodes a mutation's input into a data type the same way a json request body is
+func fromInput(metaData types.MetaData, input any) (types.DataType, error) {
+    obj, ok := input.(map[string]any)
+    if !ok {
+        return nil, errors.New("input must be an object")
+    }
+    for key, value := range obj {
+        if t, ok := value.(time.Time); ok {
+            obj[key] = t.Format(time.RFC3339Nano)
+        }
+    }
+    return fromDocument(metaData, obj)
+}
+
+func (s *Server) resolveCreate(metaData types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        data, err := fromInput(metaData, p.Args["input"])
+        if err != nil {
+            return nil, err
+        }
+        data = withServerOnly(data, nil)
+        if err := checkWriter(data, ownerId); err != nil {
+            return nil, errors.New("Not Authorized")
+        }
+        if !data.Validate() {
+            return nil, errors.New("Invalid " + metaData.GetType().Name())
+        }
+        unlock, err := s.lockQuota(data.TypeString(), ownerId)
+        if err != nil {
+            return nil, quotaError(err)
+        }
+        defer unlock()
+        if err := s.quotaAllows(metaData, ownerId, nil, data, false); err != nil {
+            return nil, quotaError(err)
+        }
+        created, err := s.db.Create(data)
+        if err != nil {
+            log.Println("Could not create object:", err)
+            return nil, errors.New("Could not create " + metaData.GetType().Name())
+        }
+        s.audit(p.Context, ownerId, auditCreate, nil, created)
+        return newGraphqlRecord(created, ownerId)
+    }
+}
+
+// sparse update, like PUT /data/{dataType}
+func (s *Server) resolveUpdate(metaData types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        data, err := fromInput(metaData, p.Args["input"])
+        if err != nil {
+            return nil, err
+        }
+        data = s.preserveServerOnly(metaData, data, ownerId)
+        if err := checkWriter(data, ownerId); err != nil {
+            return nil, errors.New("Not Authorized")
+        }
+        if !data.Validate() {
+            return nil, errors.New("Invalid " + metaData.GetType().Name())
+        }
+        unlock, err := s.lockQuota(data.TypeString(), ownerId)
+        if err != nil {
+            return nil, quotaError(err)
+        }
+        defer unlock()
+        before := s.stored(metaData, store.GetId(data), ownerId)
+        if before != nil {
+            if err := s.quotaAllows(metaData, ownerId, before, data, true); err != nil {
+                return nil, quotaError(err)
+            }
+        }
+        updated, err := s.db.Update(data)
+        if err != nil {
+            log.Println(err)
+            if errors.Is(err, store.VersionConflict{}) {
+                return nil, errors.New("Conflict: " + metaData.GetType().Name() + " " + strconv.FormatInt(store.GetId(data), 10) + " has been modified")
+            }
+            return nil, errors.New("Could not update " + metaData.GetType().Name())
+        }
+        s.audit(p.Context, ownerId, auditUpdate, before, updated)
+        return newGraphqlRecord(updated, ownerId)
+    }
+}
+
+func (s *Server) resolveDelete(metaData types.MetaData) graphql.FieldResolveFn {
+    return func(p graphql.ResolveParams) (any, error) {
+        ownerId, err := ownerIdFromContext(p.Context)
+        if err != nil {
+            return nil, err
+        }
+        id, _ := p.Args["id"].(int)
+        before := s.stored(metaData, int64(id), ownerId)
+        deleted, err := s.db.Delete(metaData, int64(id), ownerId, 0)
+        if err != nil {
+            log.Println(err)
+            return nil, errors.New("Could not delete " + metaData.GetType().Name())
+        }
+        if store.HasTrash(metaData) {
+            s.audit(p.Context, ownerId, auditDelete, before, deleted)
+        } else {
+            s.audit(p.Context, ownerId, auditDelete, deleted, nil)
+        }
+        return newGraphqlRecord(deleted, ownerId)
+    }
+}
+
+type graphqlRequest struct {
+    Query string `json:"query"`
+    OperationName string `json:"operationName"`
+    Variables map[string]any `json:"variables"`
+}
+
+func (s *Server) handleGraphql(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+        http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+        return
+    }
+
+    var req graphqlRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        log.Println(err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    result := graphql.Do(graphql.Params{
+        Schema: s.graphql,
+        RequestString: req.Query,
+        OperationName: req.OperationName,
+        VariableValues: req.Variables,
+        Context: context.WithValue(r.Context(), ownerIdKey, ownerId),
+    })
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, no-cache")
+    json.NewEncoder(w).Encode(result)
+}
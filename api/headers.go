@@ -0,0 +1,104 @@
+package api
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "slices"
+    "time"
+)
+
+// which other origins may call the api from browsers
+type CorsPolicy struct {
+    // exact origins like https://app.example.com, or * for any when credentials aren't allowed
+    Origins []string
+    Methods []string
+    Headers []string
+    // send the session cookie with cross origin requests
+    Credentials bool
+    // how long browsers may cache a preflight
+    MaxAge time.Duration
+}
+
+// response headers a cross origin caller may read
+var corsExposedHeaders = []string{"ETag", "Last-Modified", "Location", "Retry-After", "Accept-Patch", requestIdHeader}
+
+func DefaultCorsPolicy() CorsPolicy {
+    return CorsPolicy{
+        Methods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+        Headers: []string{"Accept", "Content-Type", "If-Match", "If-None-Match", csrfHeader, requestIdHeader},
+        MaxAge: 10 * time.Minute,
+    }
+}
+
+func (p CorsPolicy) allowsOrigin(origin string) bool {
+    return slices.Contains(p.Origins, origin) || (!p.Credentials && slices.Contains(p.Origins, "*"))
+}
+
+// answers preflights and marks responses to allowed origins readable, preflights from
+// other origins are refused
+func (s *Server) cors(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+        if origin == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Origin")
+        if !s.corsPolicy.allowsOrigin(origin) {
+            if preflight {
+                http.Error(w, "Forbidden", http.StatusForbidden)
+                return
+            }
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if s.corsPolicy.Credentials {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Allow-Credentials", "true")
+        } else if slices.Contains(s.corsPolicy.Origins, "*") {
+            w.Header().Set("Access-Control-Allow-Origin", "*")
+        } else {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+        }
+        if !preflight {
+            w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+            next.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+        if !slices.Contains(s.corsPolicy.Methods, r.Header.Get("Access-Control-Request-Method")) {
+            http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        w.Header().Set("Access-Control-Allow-Methods", strings.Join(s.corsPolicy.Methods, ", "))
+        w.Header().Set("Access-Control-Allow-Headers", strings.Join(s.corsPolicy.Headers, ", "))
+        if s.corsPolicy.MaxAge > 0 {
+            w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(s.corsPolicy.MaxAge.Seconds())))
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })
+}
+
+// the frontend only loads its own scripts and styles, profile pictures come from google
+const DefaultContentSecurityPolicy = "default-src 'self'; img-src 'self' https: data:; style-src 'self' 'unsafe-inline'; " +
+    "object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// headers asking browsers to lock down every response, api and static files alike
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.Header().Set("X-Frame-Options", "DENY")
+        w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+        if s.contentSecurityPolicy != "" {
+            w.Header().Set("Content-Security-Policy", s.contentSecurityPolicy)
+        }
+        // browsers ignore it over plain http
+        if s.hstsMaxAge > 0 && (r.TLS != nil || s.secureCookies) {
+            w.Header().Set("Strict-Transport-Security", "max-age=" + strconv.Itoa(int(s.hstsMaxAge.Seconds())) + "; includeSubDomains")
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,574 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "reflect"
+    "strings"
+    "sort"
+    "fmt"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+func schemaRef(name string) map[string]any {
+    return map[string]any{ "$ref": "#/components/schemas/" + name }
+}
+
+// json schema for a field's go type, as it's encoded in request and response bodies
+func fieldSchema(typ reflect.Type) map[string]any {
+    if typ.Kind() == reflect.Pointer {
+        schema := fieldSchema(typ.Elem())
+        schema["nullable"] = true
+        return schema
+    }
+    if typ == timeType {
+        return map[string]any{ "type": "string", "format": "date-time" }
+    }
+    switch typ.Kind() {
+    case reflect.Bool:
+        return map[string]any{ "type": "boolean" }
+    case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+        return map[string]any{ "type": "integer", "format": "int32" }
+    case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+        return map[string]any{ "type": "integer", "format": "int64" }
+    case reflect.Float32:
+        return map[string]any{ "type": "number", "format": "float" }
+    case reflect.Float64:
+        return map[string]any{ "type": "number", "format": "double" }
+    case reflect.String:
+        return map[string]any{ "type": "string" }
+    case reflect.Slice, reflect.Array:
+        if typ.Elem().Kind() == reflect.Uint8 {
+            return map[string]any{ "type": "string", "format": "byte" }
+        }
+        return map[string]any{ "type": "array", "items": map[string]any{} }
+    }
+    return map[string]any{ "type": "object" }
+}
+
+// json schema for a data type's record, server_only columns are left out
+func recordSchema(metaData types.MetaData) map[string]any {
+    properties := make(map[string]any)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if col.Visibility == store.ServerOnly {
+            continue
+        }
+        schema := fieldSchema(col.Field.Type)
+        if col.Managed {
+            schema["readOnly"] = true
+        }
+        if col.Visibility == store.OwnerOnly {
+            schema["description"] = "only returned to the record's owner or author"
+        }
+        properties[col.JsonName] = schema
+    }
+    return map[string]any{
+        "type": "object",
+        "properties": properties,
+    }
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+    return map[string]any{
+        "application/json": map[string]any{ "schema": schema },
+    }
+}
+
+func jsonResponse(description string, schema map[string]any) map[string]any {
+    return map[string]any{
+        "description": description,
+        "content": jsonContent(schema),
+    }
+}
+
+func listOf(schema map[string]any) map[string]any {
+    return map[string]any{ "type": "array", "items": schema }
+}
+
+func textResponse(description string) map[string]any {
+    return map[string]any{ "description": description }
+}
+
+func queryParam(name string, description string) map[string]any {
+    return map[string]any{
+        "name": name,
+        "in": "query",
+        "description": description,
+        "schema": map[string]any{ "type": "string" },
+    }
+}
+
+func headerParam(name string, description string) map[string]any {
+    return map[string]any{
+        "name": name,
+        "in": "header",
+        "description": description,
+        "schema": map[string]any{ "type": "string" },
+    }
+}
+
+var idParam = map[string]any{
+    "name": "id",
+    "in": "path",
+    "required": true,
+    "schema": map[string]any{ "type": "integer", "format": "int64" },
+}
+
+// query params for a data type's queries
+func queryParams(metaData types.MetaData) []any {
+    builders := metaData.GetQueries()
+    names := make([]string, 0, len(builders))
+    for name := range builders {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    params := make([]any, 0)
+    for _, name := range names {
+        builder := builders[name]
+        params = append(params, queryParam(name, builder.Format + ", on " + builder.Field))
+    }
+    return params
+}
+
+// query params shaping the records returned by a read - fields and expand
+func renderParams(metaData types.MetaData) []any {
+    params := []any{ queryParam("fields", "comma separated columns to return, the id is always returned") }
+    relations, err := store.GetRelations(metaData.GetType())
+    if err == nil && len(relations) > 0 {
+        names := make([]string, 0)
+        for _, relation := range relations {
+            names = append(names, relation.Name)
+        }
+        params = append(params, queryParam("expand", "comma separated relations to embed: " + strings.Join(names, ", ")))
+    }
+    return params
+}
+
+// paths for the /data and /trash routes of a data type
+func dataPaths(dataType string, metaData types.MetaData) map[string]any {
+    name := metaData.GetType().Name()
+    record := schemaRef(name)
+    tags := []string{dataType}
+    common := map[string]any{
+        "400": textResponse("Bad Request"),
+        "401": textResponse("Not Authorized"),
+    }
+    withErrors := func(responses map[string]any) map[string]any {
+        for status, response := range common {
+            if _, exists := responses[status]; !exists {
+                responses[status] = response
+            }
+        }
+        return responses
+    }
+    ifMatch := make([]any, 0)
+    if _, err := store.GetVersion(reflect.New(metaData.GetType()).Elem().Interface()); err == nil {
+        ifMatch = append(ifMatch, headerParam("If-Match", "ETag of the version being replaced, a mismatch gets a 412"))
+    }
+    body := map[string]any{
+        "required": true,
+        "content": jsonContent(record),
+    }
+
+    paths := map[string]any{
+        "/data/" + dataType: map[string]any{
+            "get": map[string]any{
+                "tags": tags,
+                "summary": "List " + metaData.TableName() + " matching the queries",
+                "parameters": append(queryParams(metaData), renderParams(metaData)...),
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("matching " + metaData.TableName(), listOf(record)),
+                    "304": textResponse("Not Modified"),
+                }),
+            },
+            "post": map[string]any{
+                "tags": tags,
+                "summary": "Create a " + dataType,
+                "requestBody": body,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the created " + dataType, record),
+                    "403": textResponse("Quota exceeded"),
+                }),
+            },
+            "put": map[string]any{
+                "tags": tags,
+                "summary": "Sparse update of a " + dataType + ", zero valued fields are left unchanged",
+                "parameters": ifMatch,
+                "requestBody": body,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the updated " + dataType, record),
+                    "403": textResponse("Quota exceeded"),
+                    "409": textResponse("Conflict"),
+                    "412": textResponse("Precondition Failed"),
+                }),
+            },
+        },
+        "/data/" + dataType + "/{id}": map[string]any{
+            "parameters": []any{idParam},
+            "get": map[string]any{
+                "tags": tags,
+                "summary": "Get a " + dataType,
+                "parameters": renderParams(metaData),
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the " + dataType, record),
+                    "304": textResponse("Not Modified"),
+                    "404": textResponse("Not Found"),
+                }),
+            },
+            "put": map[string]any{
+                "tags": tags,
+                "summary": "Create or replace the " + dataType + " at id",
+                "parameters": ifMatch,
+                "requestBody": body,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the replaced " + dataType, record),
+                    "201": jsonResponse("the created " + dataType, record),
+                    "403": textResponse("Quota exceeded"),
+                    "404": textResponse("No record was ever created at id, or it's someone else's"),
+                    "409": textResponse("Conflict"),
+                    "412": textResponse("Precondition Failed"),
+                }),
+            },
+            "patch": map[string]any{
+                "tags": tags,
+                "summary": "Patch a " + dataType,
+                "parameters": ifMatch,
+                "requestBody": map[string]any{
+                    "required": true,
+                    "content": map[string]any{
+                        "application/merge-patch+json": map[string]any{ "schema": map[string]any{ "type": "object" } },
+                        "application/json-patch+json": map[string]any{ "schema": listOf(map[string]any{ "type": "object" }) },
+                    },
+                },
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the patched " + dataType, record),
+                    "403": textResponse("Quota exceeded"),
+                    "404": textResponse("Not Found"),
+                    "409": textResponse("Conflict"),
+                    "412": textResponse("Precondition Failed"),
+                    "415": textResponse("Unsupported Media Type"),
+                }),
+            },
+            "delete": map[string]any{
+                "tags": tags,
+                "summary": "Delete a " + dataType,
+                "parameters": ifMatch,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the deleted " + dataType, record),
+                    "404": textResponse("Not Found"),
+                    "412": textResponse("Precondition Failed"),
+                }),
+            },
+        },
+        "/data/" + dataType + "/count": map[string]any{
+            "get": map[string]any{
+                "tags": tags,
+                "summary": "Count " + metaData.TableName() + " matching the queries",
+                "parameters": queryParams(metaData),
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the count", map[string]any{
+                        "type": "object",
+                        "properties": map[string]any{ "count": map[string]any{ "type": "integer" } },
+                    }),
+                }),
+            },
+        },
+        "/data/" + dataType + "/aggregate": map[string]any{
+            "get": map[string]any{
+                "tags": tags,
+                "summary": "Aggregate " + metaData.TableName() + " matching the queries",
+                "parameters": append(queryParams(metaData),
+                    queryParam("aggregate", "comma separated count, or fn:column with fn one of count, min, max, sum, avg"),
+                    queryParam("groupBy", "comma separated columns to group by"),
+                ),
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("a row per group keyed by group column and count or <fn>_<column>", listOf(map[string]any{ "type": "object" })),
+                }),
+            },
+        },
+    }
+
+    if store.HasTrash(metaData) {
+        paths["/trash/" + dataType] = map[string]any{
+            "get": map[string]any{
+                "tags": tags,
+                "summary": "Deleted " + metaData.TableName() + ", most recent first",
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("deleted " + metaData.TableName(), listOf(record)),
+                }),
+            },
+        }
+        paths["/trash/" + dataType + "/{id}"] = map[string]any{
+            "parameters": []any{idParam},
+            "delete": map[string]any{
+                "tags": tags,
+                "summary": "Purge a deleted " + dataType,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the purged " + dataType, record),
+                    "404": textResponse("Not Found"),
+                }),
+            },
+        }
+        paths["/trash/" + dataType + "/{id}/restore"] = map[string]any{
+            "parameters": []any{idParam},
+            "post": map[string]any{
+                "tags": tags,
+                "summary": "Restore a deleted " + dataType,
+                "responses": withErrors(map[string]any{
+                    "200": jsonResponse("the restored " + dataType, record),
+                    "404": textResponse("Not Found"),
+                }),
+            },
+        }
+    }
+    return paths
+}
+
+// OpenAPI 3 document generated from types.MetaDataMap
+func openapiDocument() map[string]any {
+    schemas := make(map[string]any)
+    paths := make(map[string]any)
+    for dataType, metaData := range types.MetaDataMap {
+        schemas[metaData.GetType().Name()] = recordSchema(metaData)
+        for path, item := range dataPaths(dataType, metaData) {
+            paths[path] = item
+        }
+    }
+
+    paths["/search"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Full text search across data types",
+            "parameters": []any{
+                queryParam("q", "search terms"),
+                queryParam("types", "comma separated data types to search"),
+                queryParam("limit", "maximum results, 1 to 100"),
+            },
+            "responses": map[string]any{
+                "200": jsonResponse("hits, best match first", listOf(map[string]any{
+                    "type": "object",
+                    "properties": map[string]any{
+                        "type": map[string]any{ "type": "string" },
+                        "rank": map[string]any{ "type": "number" },
+                        "data": map[string]any{ "type": "object" },
+                        "highlights": map[string]any{
+                            "type": "object",
+                            "additionalProperties": map[string]any{ "type": "string" },
+                        },
+                    },
+                })),
+                "400": textResponse("Bad Request"),
+            },
+        },
+    }
+    paths["/graphql"] = map[string]any{
+        "post": map[string]any{
+            "summary": "GraphQL queries and mutations over the data types",
+            "requestBody": map[string]any{
+                "required": true,
+                "content": jsonContent(map[string]any{
+                    "type": "object",
+                    "properties": map[string]any{
+                        "query": map[string]any{ "type": "string" },
+                        "operationName": map[string]any{ "type": "string" },
+                        "variables": map[string]any{ "type": "object" },
+                    },
+                    "required": []string{"query"},
+                }),
+            },
+            "responses": map[string]any{
+                "200": jsonResponse("the graphql result", map[string]any{ "type": "object" }),
+            },
+        },
+    }
+    zipContent := map[string]any{
+        "application/zip": map[string]any{ "schema": map[string]any{ "type": "string", "format": "binary" } },
+    }
+    paths["/audit"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Audit log entries newest first, only those about the session's own account and records unless the session is an admin",
+            "parameters": []any{
+                queryParam("actor", "id of the user who acted"),
+                queryParam("user", "id of the user whose account or records the entries concern"),
+                queryParam("action", "create, update, delete, restore, purge, import, login, logout, delete_account, restore_account or set_quotas"),
+                queryParam("type", "data type"),
+                queryParam("id", "record id"),
+                queryParam("since", "RFC3339 time, inclusive"),
+                queryParam("until", "RFC3339 time, exclusive"),
+                queryParam("before", "only entries with smaller ids, for paging"),
+                queryParam("limit", fmt.Sprintf("at most this many entries, default %d, max %d", defaultAuditLimit, maxAuditLimit)),
+            },
+            "responses": map[string]any{
+                "200": jsonResponse("audit log entries", listOf(map[string]any{ "type": "object" })),
+                "403": textResponse("Forbidden"),
+            },
+        },
+    }
+    paths["/account"] = map[string]any{
+        "delete": map[string]any{
+            "summary": "Delete the session's account, purged with everything it owns or authored after the trash retention unless the user signs in again",
+            "responses": map[string]any{
+                "202": jsonResponse("records moved to the trash and when the account will be purged", map[string]any{
+                    "type": "object",
+                    "properties": map[string]any{
+                        "records": map[string]any{ "type": "integer" },
+                        "purge_after": map[string]any{ "type": "string", "format": "date-time" },
+                    },
+                }),
+            },
+        },
+    }
+    paths["/account/export"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Archive of every record the session owns or authored, a json array per data type plus manifest.json",
+            "responses": map[string]any{
+                "200": map[string]any{ "description": "zip archive", "content": zipContent },
+            },
+        },
+    }
+    paths["/account/import"] = map[string]any{
+        "post": map[string]any{
+            "summary": "Re-create the records of an export archive under the session's user",
+            "requestBody": map[string]any{ "required": true, "content": zipContent },
+            "responses": map[string]any{
+                "201": jsonResponse("exported id to created id per data type", map[string]any{ "type": "object" }),
+                "400": textResponse("Bad Request"),
+                "403": textResponse("Quota exceeded"),
+                "413": textResponse("Request Entity Too Large"),
+            },
+        },
+    }
+    quota := map[string]any{
+        "type": "object",
+        "properties": map[string]any{
+            "max_records": map[string]any{ "type": "integer" },
+            "max_bytes": map[string]any{ "type": "integer" },
+        },
+    }
+    paths["/account/usage"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Records and bytes the session stores of each data type, and its quotas, 0 is unlimited",
+            "parameters": []any{
+                queryParam("user", "id of another user, admins only"),
+            },
+            "responses": map[string]any{
+                "200": jsonResponse("usage and quota per data type", map[string]any{
+                    "type": "object",
+                    "additionalProperties": map[string]any{
+                        "type": "object",
+                        "properties": map[string]any{
+                            "records": map[string]any{ "type": "integer" },
+                            "bytes": map[string]any{ "type": "integer" },
+                            "max_records": map[string]any{ "type": "integer" },
+                            "max_bytes": map[string]any{ "type": "integer" },
+                        },
+                    },
+                }),
+                "403": textResponse("Forbidden"),
+            },
+        },
+    }
+    quotas := map[string]any{
+        "type": "object",
+        "additionalProperties": quota,
+    }
+    paths["/admin/quotas/{userId}"] = map[string]any{
+        "parameters": []any{
+            map[string]any{
+                "name": "userId",
+                "in": "path",
+                "required": true,
+                "schema": map[string]any{ "type": "integer", "format": "int64" },
+            },
+        },
+        "get": map[string]any{
+            "summary": "A user's quota overrides per data type, admins only",
+            "responses": map[string]any{
+                "200": jsonResponse("quota overrides per data type", quotas),
+                "403": textResponse("Forbidden"),
+            },
+        },
+        "put": map[string]any{
+            "summary": "Replace a user's quota overrides, data types left out use the server's defaults, admins only",
+            "requestBody": map[string]any{
+                "required": true,
+                "content": jsonContent(quotas),
+            },
+            "responses": map[string]any{
+                "200": jsonResponse("the quota overrides", quotas),
+                "400": textResponse("Bad Request"),
+                "403": textResponse("Forbidden"),
+            },
+        },
+    }
+    paths["/schema"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Data types and their queries",
+            "responses": map[string]any{
+                "200": jsonResponse("data types", map[string]any{ "type": "object" }),
+            },
+        },
+    }
+    paths["/auth/google/login"] = map[string]any{
+        "get": map[string]any{
+            "summary": "Start google sign in, sets the session_id cookie on return",
+            "security": []any{},
+            "responses": map[string]any{
+                "307": textResponse("redirect to google"),
+            },
+        },
+    }
+    paths["/auth/logout"] = map[string]any{
+        "post": map[string]any{
+            "summary": "End the session",
+            "responses": map[string]any{
+                "303": textResponse("logged out, redirect to /"),
+            },
+        },
+    }
+
+    return map[string]any{
+        "openapi": "3.0.3",
+        "info": map[string]any{
+            "title": "glonk",
+            "version": "1.0.0",
+        },
+        "paths": paths,
+        "components": map[string]any{
+            "schemas": schemas,
+            "securitySchemes": map[string]any{
+                "session": map[string]any{
+                    "type": "apiKey",
+                    "in": "cookie",
+                    "name": "session_id",
+                    "description": "set after signing in at /auth/google/login, expires after 20 minutes",
+                },
+                "google": map[string]any{
+                    "type": "oauth2",
+                    "flows": map[string]any{
+                        "authorizationCode": map[string]any{
+                            "authorizationUrl": "https://accounts.google.com/o/oauth2/auth",
+                            "tokenUrl": "https://oauth2.googleapis.com/token",
+                            "scopes": map[string]any{
+                                "email": "email address",
+                                "profile": "name and picture",
+                            },
+                        },
+                    },
+                },
+            },
+        },
+        "security": []any{
+            map[string]any{ "session": []string{} },
+        },
+    }
+}
+
+func (s *Server) handleOpenapi(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(openapiDocument()); err != nil {
+        log.Println("Could not encode openapi document:", err)
+    }
+}
@@ -0,0 +1,514 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "reflect"
+    "strings"
+    "strconv"
+    "errors"
+    "fmt"
+    "log"
+    "mime"
+    "bytes"
+    "io"
+    "math/big"
+
+    "github.com/gorilla/mux"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+const (
+    mergePatchContentType = "application/merge-patch+json"
+    jsonPatchContentType = "application/json-patch+json"
+)
+
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists {
+        log.Println("No metaData for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusBadRequest)
+        return
+    }
+
+    id, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil || (contentType != mergePatchContentType && contentType != jsonPatchContentType) {
+        w.Header().Set("Accept-Patch", mergePatchContentType + ", " + jsonPatchContentType)
+        http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+        return
+    }
+
+    // If-Match is checked against the record that's patched, whose version the write is
+    // conditional on, so nothing written in between is overwritten
+    current, err := s.db.Get(metaData, id, ownerId)
+    if err != nil {
+        log.Println("Could not find data:", err)
+        if r.Header.Get("If-Match") != "" {
+            http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+            return
+        }
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+    if !ifMatches(w, r, current, ownerId) {
+        return
+    }
+    if !validateWrite(current, ownerId, w) {
+        return
+    }
+
+    // patches apply to the record as the client sees it
+    doc, err := redact(current, ownerId)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+
+    var patched any
+    if contentType == mergePatchContentType {
+        var patch any
+        if err := decodeDocument(r.Body, &patch); err != nil {
+            log.Println("Could not decode merge patch:", err)
+            http.Error(w, "Bad Request", http.StatusBadRequest)
+            return
+        }
+        patched = mergePatch(map[string]any(doc), patch)
+    } else {
+        var ops []patchOp
+        if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+            log.Println("Could not decode json patch:", err)
+            http.Error(w, "Bad Request", http.StatusBadRequest)
+            return
+        }
+        patched, err = applyJsonPatch(map[string]any(doc), ops)
+        if err != nil {
+            log.Println("Could not apply json patch:", err)
+            if errors.Is(err, errPatchTestFailed) {
+                http.Error(w, "Conflict", http.StatusConflict)
+                return
+            }
+            http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
+            return
+        }
+    }
+
+    data, err := fromDocument(metaData, patched)
+    if err != nil {
+        log.Println("Patched document does not fit data type:", err)
+        http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
+        return
+    }
+    data = withServerOnly(data, current)
+    if store.GetId(data) != id {
+        log.Println("Patch may not change the id")
+        http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
+        return
+    }
+    if !validateWrite(data, ownerId, w) {
+        return
+    }
+    if !data.Validate() {
+        log.Println("Invalid data in patch request:", data)
+        http.Error(w, "Unprocessable Entity", http.StatusUnprocessableEntity)
+        return
+    }
+    // write conditionally on the version that was patched
+    if version, err := store.GetVersion(current); err == nil {
+        data, err = store.SetVersion(data, version)
+        if err != nil {
+            log.Println(err)
+            http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    unlock, ok := s.holdQuota(w, data.TypeString(), ownerId)
+    if !ok {
+        return
+    }
+    defer unlock()
+    if !s.enforceQuota(w, metaData, ownerId, current, data, false) {
+        return
+    }
+    // a full replace rather than a sparse update so removed fields are cleared, of the
+    // live record only so a racing delete isn't undone
+    updated, err := s.db.Replace(data)
+    if err != nil {
+        log.Println(err)
+        if errors.Is(err, store.VersionConflict{}) {
+            http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+            return
+        }
+        if errors.Is(err, store.NoRows{}) {
+            http.Error(w, "Not Found", http.StatusNotFound)
+            return
+        }
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    s.audit(r.Context(), ownerId, auditUpdate, current, updated)
+
+    if etag, ok := versionETag(r, updated, ownerId); ok {
+        w.Header().Set("ETag", etag)
+    }
+    writeRecord(w, r, http.StatusOK, updated, ownerId)
+}
+
+// generic json documents
+func decodeDocument(r io.Reader, v any) error {
+    decoder := json.NewDecoder(r)
+    decoder.UseNumber()
+    return decoder.Decode(v)
+}
+
+func toDocument(data types.DataType) (any, error) {
+    encoded, err := json.Marshal(data)
+    if err != nil {
+        return nil, err
+    }
+    var doc any
+    err = decodeDocument(bytes.NewReader(encoded), &doc)
+    return doc, err
+}
+
+func fromDocument(metaData types.MetaData, doc any) (types.DataType, error) {
+    encoded, err := json.Marshal(doc)
+    if err != nil {
+        return nil, err
+    }
+    target := reflect.New(metaData.GetType())
+    decoder := json.NewDecoder(bytes.NewReader(encoded))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(target.Interface()); err != nil {
+        return nil, err
+    }
+    data, ok := target.Elem().Interface().(types.DataType)
+    if !ok {
+        return nil, errors.New("Could not convert document to " + metaData.GetType().Name())
+    }
+    return data, nil
+}
+
+// RFC 7396 JSON Merge Patch
+func mergePatch(target any, patch any) any {
+    patchObj, ok := patch.(map[string]any)
+    if !ok {
+        return patch
+    }
+    targetObj, ok := target.(map[string]any)
+    if !ok {
+        targetObj = map[string]any{}
+    }
+    for k, v := range patchObj {
+        if v == nil {
+            delete(targetObj, k)
+            continue
+        }
+        targetObj[k] = mergePatch(targetObj[k], v)
+    }
+    return targetObj
+}
+
+// RFC 6902 JSON Patch
+type patchOp struct {
+    Op string `json:"op"`
+    Path string `json:"path"`
+    From string `json:"from"`
+    Value json.RawMessage `json:"value"`
+}
+
+var errPatchTestFailed = errors.New("json patch test operation failed")
+
+func applyJsonPatch(doc any, ops []patchOp) (any, error) {
+    var err error
+    for _, op := range ops {
+        switch op.Op {
+        case "add", "replace", "test":
+            if op.Value == nil {
+                return nil, fmt.Errorf("%s operation at %s is missing a value", op.Op, op.Path)
+            }
+            var value any
+            if err := decodeDocument(bytes.NewReader(op.Value), &value); err != nil {
+                return nil, err
+            }
+            switch op.Op {
+            case "add":
+                doc, err = pointerAdd(doc, op.Path, value)
+            case "replace":
+                doc, err = pointerReplace(doc, op.Path, value)
+            case "test":
+                var current any
+                current, err = pointerGet(doc, op.Path)
+                if err == nil && !jsonEqual(current, value) {
+                    err = fmt.Errorf("%w at %s", errPatchTestFailed, op.Path)
+                }
+            }
+        case "remove":
+            doc, _, err = pointerRemove(doc, op.Path)
+        case "move":
+            if strings.HasPrefix(op.Path, op.From + "/") {
+                return nil, fmt.Errorf("cannot move %s into its own child %s", op.From, op.Path)
+            }
+            var value any
+            doc, value, err = pointerRemove(doc, op.From)
+            if err == nil {
+                doc, err = pointerAdd(doc, op.Path, value)
+            }
+        case "copy":
+            var value any
+            value, err = pointerGet(doc, op.From)
+            if err == nil {
+                doc, err = pointerAdd(doc, op.Path, deepCopy(value))
+            }
+        default:
+            err = fmt.Errorf("unknown json patch operation %q", op.Op)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    return doc, nil
+}
+
+// RFC 6902 4.6 equality of decoded documents, numbers are equal when their values are
+// so 1, 1.0 and 1e0 all match
+func jsonEqual(a any, b any) bool {
+    switch av := a.(type) {
+    case json.Number:
+        bv, ok := b.(json.Number)
+        if !ok {
+            return false
+        }
+        ar, aok := new(big.Rat).SetString(av.String())
+        br, bok := new(big.Rat).SetString(bv.String())
+        if !aok || !bok {
+            return av == bv
+        }
+        return ar.Cmp(br) == 0
+    case map[string]any:
+        bv, ok := b.(map[string]any)
+        if !ok || len(av) != len(bv) {
+            return false
+        }
+        for k, ae := range av {
+            be, exists := bv[k]
+            if !exists || !jsonEqual(ae, be) {
+                return false
+            }
+        }
+        return true
+    case []any:
+        bv, ok := b.([]any)
+        if !ok || len(av) != len(bv) {
+            return false
+        }
+        for i := range av {
+            if !jsonEqual(av[i], bv[i]) {
+                return false
+            }
+        }
+        return true
+    }
+    return reflect.DeepEqual(a, b)
+}
+
+func deepCopy(value any) any {
+    switch v := value.(type) {
+    case map[string]any:
+        c := make(map[string]any, len(v))
+        for k, e := range v {
+            c[k] = deepCopy(e)
+        }
+        return c
+    case []any:
+        c := make([]any, len(v))
+        for i, e := range v {
+            c[i] = deepCopy(e)
+        }
+        return c
+    }
+    return value
+}
+
+// RFC 6901 JSON Pointer
+func parsePointer(pointer string) ([]string, error) {
+    if pointer == "" {
+        return []string{}, nil
+    }
+    if !strings.HasPrefix(pointer, "/") {
+        return nil, fmt.Errorf("invalid json pointer %q", pointer)
+    }
+    tokens := strings.Split(pointer[1:], "/")
+    for i, token := range tokens {
+        tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+    }
+    return tokens, nil
+}
+
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+    if allowEnd && token == "-" {
+        return length, nil
+    }
+    idx, err := strconv.Atoi(token)
+    if err != nil || idx < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+        return -1, fmt.Errorf("invalid array index %q", token)
+    }
+    if idx > length || (!allowEnd && idx == length) {
+        return -1, fmt.Errorf("array index %d out of bounds", idx)
+    }
+    return idx, nil
+}
+
+func pointerGet(doc any, pointer string) (any, error) {
+    tokens, err := parsePointer(pointer)
+    if err != nil {
+        return nil, err
+    }
+    current := doc
+    for _, token := range tokens {
+        switch c := current.(type) {
+        case map[string]any:
+            value, exists := c[token]
+            if !exists {
+                return nil, fmt.Errorf("path %s does not exist", pointer)
+            }
+            current = value
+        case []any:
+            idx, err := arrayIndex(token, len(c), false)
+            if err != nil {
+                return nil, err
+            }
+            current = c[idx]
+        default:
+            return nil, fmt.Errorf("path %s does not exist", pointer)
+        }
+    }
+    return current, nil
+}
+
+// applies fn to the container holding the last token of pointer,
+// returning the updated document
+func pointerParent(doc any, pointer string, fn func(parent any, token string) (any, error)) (any, error) {
+    tokens, err := parsePointer(pointer)
+    if err != nil {
+        return nil, err
+    }
+    if len(tokens) == 0 {
+        return fn(nil, "")
+    }
+    var walk func(node any, tokens []string) (any, error)
+    walk = func(node any, tokens []string) (any, error) {
+        if len(tokens) == 1 {
+            return fn(node, tokens[0])
+        }
+        switch n := node.(type) {
+        case map[string]any:
+            child, exists := n[tokens[0]]
+            if !exists {
+                return nil, fmt.Errorf("path %s does not exist", pointer)
+            }
+            updated, err := walk(child, tokens[1:])
+            if err != nil {
+                return nil, err
+            }
+            n[tokens[0]] = updated
+            return n, nil
+        case []any:
+            idx, err := arrayIndex(tokens[0], len(n), false)
+            if err != nil {
+                return nil, err
+            }
+            updated, err := walk(n[idx], tokens[1:])
+            if err != nil {
+                return nil, err
+            }
+            n[idx] = updated
+            return n, nil
+        }
+        return nil, fmt.Errorf("path %s does not exist", pointer)
+    }
+    return walk(doc, tokens)
+}
+
+func pointerAdd(doc any, pointer string, value any) (any, error) {
+    if pointer == "" {
+        return value, nil
+    }
+    return pointerParent(doc, pointer, func(parent any, token string) (any, error) {
+        switch p := parent.(type) {
+        case map[string]any:
+            p[token] = value
+            return p, nil
+        case []any:
+            idx, err := arrayIndex(token, len(p), true)
+            if err != nil {
+                return nil, err
+            }
+            p = append(p, nil)
+            copy(p[idx + 1:], p[idx:])
+            p[idx] = value
+            return p, nil
+        }
+        return nil, fmt.Errorf("path %s does not exist", pointer)
+    })
+}
+
+func pointerRemove(doc any, pointer string) (any, any, error) {
+    if pointer == "" {
+        return nil, nil, errors.New("cannot remove the whole document")
+    }
+    var removed any
+    updated, err := pointerParent(doc, pointer, func(parent any, token string) (any, error) {
+        switch p := parent.(type) {
+        case map[string]any:
+            value, exists := p[token]
+            if !exists {
+                return nil, fmt.Errorf("path %s does not exist", pointer)
+            }
+            removed = value
+            delete(p, token)
+            return p, nil
+        case []any:
+            idx, err := arrayIndex(token, len(p), false)
+            if err != nil {
+                return nil, err
+            }
+            removed = p[idx]
+            return append(p[:idx], p[idx + 1:]...), nil
+        }
+        return nil, fmt.Errorf("path %s does not exist", pointer)
+    })
+    return updated, removed, err
+}
+
+func pointerReplace(doc any, pointer string, value any) (any, error) {
+    if _, err := pointerGet(doc, pointer); err != nil {
+        return nil, err
+    }
+    if pointer == "" {
+        return value, nil
+    }
+    doc, _, err := pointerRemove(doc, pointer)
+    if err != nil {
+        return nil, err
+    }
+    return pointerAdd(doc, pointer, value)
+}
@@ -0,0 +1,200 @@
+package api
+
+import (
+    "testing"
+    "encoding/json"
+    "strings"
+    "errors"
+)
+
+// expected of a test case that should fail without a particular error
+var errAny = errors.New("any error")
+
+func mustDecode(t *testing.T, doc string) any {
+    t.Helper()
+    var v any
+    if err := decodeDocument(strings.NewReader(doc), &v); err != nil {
+        t.Fatalf("could not decode %s: %v", doc, err)
+    }
+    return v
+}
+
+// compares documents by their encoding, maps marshal with sorted keys
+func assertDocument(t *testing.T, got any, want string, wantDoc any) {
+    t.Helper()
+    gotJson, err := json.Marshal(got)
+    if err != nil {
+        t.Fatalf("could not encode result: %v", err)
+    }
+    wantJson, _ := json.Marshal(wantDoc)
+    if string(gotJson) != string(wantJson) {
+        t.Errorf("got %s, want %s", gotJson, want)
+    }
+}
+
+// RFC 7396 appendix A
+func TestMergePatch(t *testing.T) {
+    tests := []struct {
+        target string
+        patch string
+        want string
+    }{
+        {`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+        {`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+        {`{"a":"b"}`, `{"a":null}`, `{}`},
+        {`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+        {`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+        {`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+        {`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+        {`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+        {`["a","b"]`, `["c","d"]`, `["c","d"]`},
+        {`{"a":"b"}`, `["c"]`, `["c"]`},
+        {`{"a":"foo"}`, `null`, `null`},
+        {`{"a":"foo"}`, `"bar"`, `"bar"`},
+        {`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+        {`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+        {`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+    }
+    for _, test := range tests {
+        t.Run(test.target + " " + test.patch, func(t *testing.T) {
+            got := mergePatch(mustDecode(t, test.target), mustDecode(t, test.patch))
+            assertDocument(t, got, test.want, mustDecode(t, test.want))
+        })
+    }
+}
+
+// RFC 6902 appendix A, less A.13 which is about duplicate members the json decoder
+// doesn't report
+func TestJsonPatch(t *testing.T) {
+    tests := []struct {
+        name string
+        doc string
+        patch string
+        want string
+        // the error expected instead of a result, errAny for any error
+        err error
+    }{
+        {"A.1 adding an object member", `{"foo":"bar"}`,
+            `[{"op":"add","path":"/baz","value":"qux"}]`,
+            `{"baz":"qux","foo":"bar"}`, nil},
+        {"A.2 adding an array element", `{"foo":["bar","baz"]}`,
+            `[{"op":"add","path":"/foo/1","value":"qux"}]`,
+            `{"foo":["bar","qux","baz"]}`, nil},
+        {"A.3 removing an object member", `{"baz":"qux","foo":"bar"}`,
+            `[{"op":"remove","path":"/baz"}]`,
+            `{"foo":"bar"}`, nil},
+        {"A.4 removing an array element", `{"foo":["bar","qux","baz"]}`,
+            `[{"op":"remove","path":"/foo/1"}]`,
+            `{"foo":["bar","baz"]}`, nil},
+        {"A.5 replacing a value", `{"baz":"qux","foo":"bar"}`,
+            `[{"op":"replace","path":"/baz","value":"boo"}]`,
+            `{"baz":"boo","foo":"bar"}`, nil},
+        {"A.6 moving a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+            `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+            `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+        {"A.7 moving an array element", `{"foo":["all","grass","cows","eat"]}`,
+            `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+            `{"foo":["all","cows","eat","grass"]}`, nil},
+        {"A.8 testing a value: success", `{"baz":"qux","foo":["a",2,"c"]}`,
+            `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+            `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+        {"A.9 testing a value: error", `{"baz":"qux"}`,
+            `[{"op":"test","path":"/baz","value":"bar"}]`,
+            ``, errPatchTestFailed},
+        {"A.10 adding a nested member object", `{"foo":"bar"}`,
+            `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+            `{"foo":"bar","child":{"grandchild":{}}}`, nil},
+        {"A.11 ignoring unrecognized elements", `{"foo":"bar"}`,
+            `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`,
+            `{"foo":"bar","baz":"qux"}`, nil},
+        {"A.12 adding to a nonexistent target", `{"foo":"bar"}`,
+            `[{"op":"add","path":"/baz/bat","value":"qux"}]`,
+            ``, errAny},
+        {"A.14 ~ escape ordering", `{"/":9,"~1":10}`,
+            `[{"op":"test","path":"/~01","value":10}]`,
+            `{"/":9,"~1":10}`, nil},
+        {"A.15 comparing strings and numbers", `{"/":9,"~1":10}`,
+            `[{"op":"test","path":"/~01","value":"10"}]`,
+            ``, errPatchTestFailed},
+        {"A.16 adding an array value", `{"foo":["bar"]}`,
+            `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`,
+            `{"foo":["bar",["abc","def"]]}`, nil},
+        {"numbers compare by value", `{"a":1,"b":[1.0,{"c":100}]}`,
+            `[{"op":"test","path":"/a","value":1.0},{"op":"test","path":"/b","value":[1e0,{"c":1e2}]}]`,
+            `{"a":1,"b":[1.0,{"c":100}]}`, nil},
+        {"numbers of different values", `{"a":1}`,
+            `[{"op":"test","path":"/a","value":1.5}]`,
+            ``, errPatchTestFailed},
+        {"appending with -", `{"foo":[1]}`,
+            `[{"op":"add","path":"/foo/-","value":2}]`,
+            `{"foo":[1,2]}`, nil},
+        {"copying a value", `{"foo":{"bar":[1]}}`,
+            `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/bar/-","value":2}]`,
+            `{"foo":{"bar":[1]},"baz":{"bar":[1,2]}}`, nil},
+        {"moving into a child", `{"foo":{"bar":1}}`,
+            `[{"op":"move","from":"/foo","path":"/foo/bar"}]`,
+            ``, errAny},
+        {"removing past the end", `{"foo":[1]}`,
+            `[{"op":"remove","path":"/foo/1"}]`,
+            ``, errAny},
+        {"leading zero index", `{"foo":[1,2]}`,
+            `[{"op":"replace","path":"/foo/01","value":3}]`,
+            ``, errAny},
+        {"unknown operation", `{"foo":1}`,
+            `[{"op":"frobnicate","path":"/foo"}]`,
+            ``, errAny},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            var ops []patchOp
+            if err := json.Unmarshal([]byte(test.patch), &ops); err != nil {
+                t.Fatalf("could not decode patch: %v", err)
+            }
+            got, err := applyJsonPatch(mustDecode(t, test.doc), ops)
+            if test.err != nil {
+                if err == nil {
+                    t.Fatalf("got %v, want an error", got)
+                }
+                if test.err != errAny && !errors.Is(err, test.err) {
+                    t.Fatalf("got error %v, want %v", err, test.err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            assertDocument(t, got, test.want, mustDecode(t, test.want))
+        })
+    }
+}
+
+// RFC 6901 section 5
+func TestPointerGet(t *testing.T) {
+    doc := `{"foo":["bar","baz"],"":0,"a/b":1,"c%d":2,"e^f":3,"g|h":4,"i\\j":5,"k\"l":6," ":7,"m~n":8}`
+    tests := []struct {
+        pointer string
+        want string
+    }{
+        {``, doc},
+        {`/foo`, `["bar","baz"]`},
+        {`/foo/0`, `"bar"`},
+        {`/`, `0`},
+        {`/a~1b`, `1`},
+        {`/c%d`, `2`},
+        {`/e^f`, `3`},
+        {`/g|h`, `4`},
+        {`/i\j`, `5`},
+        {`/k"l`, `6`},
+        {`/ `, `7`},
+        {`/m~0n`, `8`},
+    }
+    for _, test := range tests {
+        t.Run(test.pointer, func(t *testing.T) {
+            got, err := pointerGet(mustDecode(t, doc), test.pointer)
+            if err != nil {
+                t.Fatalf("unexpected error: %v", err)
+            }
+            assertDocument(t, got, test.want, mustDecode(t, test.want))
+        })
+    }
+}
@@ -0,0 +1,336 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "strconv"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+
+    "github.com/gorilla/mux"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// serialises each user's writes to a data type within this server, so concurrent writes can't
+// all pass the quota check before any of them is stored. locks are dropped once nobody holds or waits on them
+type quotaLocks struct {
+    mu sync.Mutex
+    locks map[quotaKey]*quotaLock
+}
+
+type quotaKey struct {
+    dataType string
+    ownerId int64
+}
+
+type quotaLock struct {
+    sync.Mutex
+    holders int
+}
+
+// locks ownerId's writes to a data type, returning the unlock
+func (l *quotaLocks) lock(dataType string, ownerId int64) func() {
+    key := quotaKey{ dataType, ownerId }
+    l.mu.Lock()
+    if l.locks == nil {
+        l.locks = make(map[quotaKey]*quotaLock)
+    }
+    lock, exists := l.locks[key]
+    if !exists {
+        lock = &quotaLock{}
+        l.locks[key] = lock
+    }
+    lock.holders += 1
+    l.mu.Unlock()
+
+    lock.Lock()
+    return func() {
+        lock.Unlock()
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        lock.holders -= 1
+        if lock.holders == 0 {
+            delete(l.locks, key)
+        }
+    }
+}
+
+// takes ownerId's quota lock of a data type, here and then in the store when a quota applies
+// so other servers sharing it wait too. returns the unlock
+func (s *Server) lockQuota(dataType string, ownerId int64) (func(), error) {
+    unlock := s.quotaLocks.lock(dataType, ownerId)
+    quota, err := s.quota(dataType, ownerId)
+    if err != nil {
+        unlock()
+        return nil, err
+    }
+    if quota.MaxRecords == 0 && quota.MaxBytes == 0 {
+        return unlock, nil
+    }
+    release, err := s.db.LockQuota(dataType, ownerId)
+    if err != nil {
+        unlock()
+        return nil, err
+    }
+    return func() {
+        if err := release(); err != nil {
+            log.Println("Could not release quota lock:", err)
+        }
+        unlock()
+    }, nil
+}
+
+// takes the quota lock, responding 500 when it can't be
+func (s *Server) holdQuota(w http.ResponseWriter, dataType string, ownerId int64) (func(), bool) {
+    unlock, err := s.lockQuota(dataType, ownerId)
+    if err != nil {
+        log.Println("Could not lock quota:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return nil, false
+    }
+    return unlock, true
+}
+
+type quotaExceeded struct {
+    dataType string
+    limit string
+}
+
+func (e quotaExceeded) Error() string {
+    return fmt.Sprintf("Quota exceeded: %s %s", e.dataType, e.limit)
+}
+
+// the quota of ownerId for a data type, an admin's override or the server's default
+func (s *Server) quota(dataType string, ownerId int64) (store.Quota, error) {
+    overrides, err := s.db.GetQuotaOverrides(ownerId)
+    if err != nil {
+        return store.Quota{}, err
+    }
+    if quota, exists := overrides[dataType]; exists {
+        return quota, nil
+    }
+    if quota, exists := s.quotas[dataType]; exists {
+        return quota, nil
+    }
+    return s.defaultQuota, nil
+}
+
+// checks ownerId may store records and bytes more of a data type. callers hold the
+// quota lock of the data type until the write is stored
+func (s *Server) checkQuota(dataType string, ownerId int64, records int64, bytes int64) error {
+    if records <= 0 && bytes <= 0 {
+        return nil
+    }
+    quota, err := s.quota(dataType, ownerId)
+    if err != nil || (quota.MaxRecords == 0 && quota.MaxBytes == 0) {
+        return err
+    }
+    usage, err := s.db.Usage(types.MetaDataMap[dataType], ownerId)
+    if err != nil {
+        return err
+    }
+    if quota.MaxRecords > 0 && records > 0 && usage.Records + records > quota.MaxRecords {
+        return quotaExceeded{ dataType, fmt.Sprintf("records, limit is %d", quota.MaxRecords) }
+    }
+    if quota.MaxBytes > 0 && bytes > 0 && usage.Bytes + bytes > quota.MaxBytes {
+        return quotaExceeded{ dataType, fmt.Sprintf("bytes, limit is %d", quota.MaxBytes) }
+    }
+    return nil
+}
+
+// checks the quota for a write of after over before, before is nil for creates.
+// sparse writes, like PUT /data/{dataType}, only change the fields after sets
+func (s *Server) quotaAllows(metaData types.MetaData, ownerId int64, before types.DataType, after types.DataType, sparse bool) error {
+    if _, ok := writerColumn(metaData); !ok {
+        return nil
+    }
+    var records int64
+    var bytes int64
+    var err error
+    switch {
+    case before == nil:
+        records = 1
+        bytes, err = store.RecordBytes(after)
+    case sparse:
+        bytes, err = store.UpdatedBytes(before, after)
+    default:
+        var stored int64
+        if stored, err = store.RecordBytes(before); err == nil {
+            bytes, err = store.RecordBytes(after)
+            bytes -= stored
+        }
+    }
+    if err != nil {
+        return err
+    }
+    return s.checkQuota(after.TypeString(), ownerId, records, bytes)
+}
+
+// responds 403 when the write would take the session over quota
+func (s *Server) enforceQuota(w http.ResponseWriter, metaData types.MetaData, ownerId int64, before types.DataType, after types.DataType, sparse bool) bool {
+    return quotaResponse(w, s.quotaAllows(metaData, ownerId, before, after, sparse))
+}
+
+// responds 403 when adding records and bytes of a data type would take ownerId over quota
+func (s *Server) withinQuota(w http.ResponseWriter, dataType string, ownerId int64, records int64, bytes int64) bool {
+    return quotaResponse(w, s.checkQuota(dataType, ownerId, records, bytes))
+}
+
+func quotaResponse(w http.ResponseWriter, err error) bool {
+    if err == nil {
+        return true
+    }
+    log.Println(err)
+    if errors.As(err, &quotaExceeded{}) {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return false
+    }
+    http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+    return false
+}
+
+// graphql error for a failed quota check, internal errors are only logged
+func quotaError(err error) error {
+    if errors.As(err, &quotaExceeded{}) {
+        return err
+    }
+    log.Println("Could not check quota:", err)
+    return errors.New("Could not check quota")
+}
+
+type quotaUsage struct {
+    store.Usage
+    store.Quota
+}
+
+// what the session stores of each data type against its quotas, admins may ask about any user=
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    userId, err := int64Param(r, "user")
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    if userId == 0 {
+        userId = ownerId
+    }
+    if userId != ownerId && !s.isAdmin(ownerId) {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    usages := make(map[string]quotaUsage)
+    for _, dataType := range accountTypes() {
+        usage, err := s.db.Usage(types.MetaDataMap[dataType], userId)
+        if err != nil {
+            log.Println("Could not get usage:", err)
+            http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+        }
+        quota, err := s.quota(dataType, userId)
+        if err != nil {
+            log.Println("Could not get quota:", err)
+            http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+        }
+        usages[dataType] = quotaUsage{ usage, quota }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, no-cache")
+    json.NewEncoder(w).Encode(usages)
+}
+
+// responds 403 unless the session is an admin
+func (s *Server) adminOnly(endpoint func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ownerId, err := getOwnerIdFromRequestHeaders(r)
+        if err != nil || !s.isAdmin(ownerId) {
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
+        endpoint(w, r)
+    }
+}
+
+func (s *Server) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
+    userId, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    overrides, err := s.db.GetQuotaOverrides(userId)
+    if err != nil {
+        log.Println("Could not get quota overrides:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, no-cache")
+    json.NewEncoder(w).Encode(overrides)
+}
+
+// replaces a user's quota overrides, data types left out go back to the defaults
+func (s *Server) handleSetQuotas(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    userId, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    var overrides map[string]store.Quota
+    if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+        log.Println("Could not decode quotas:", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    for dataType, quota := range overrides {
+        metaData, exists := types.MetaDataMap[dataType]
+        if _, ok := writerColumn(metaData); !exists || !ok || quota.MaxRecords < 0 || quota.MaxBytes < 0 {
+            http.Error(w, "Invalid quota for " + dataType, http.StatusBadRequest)
+            return
+        }
+    }
+
+    previous, err := s.db.GetQuotaOverrides(userId)
+    if err == nil {
+        err = s.db.SetQuotaOverrides(userId, overrides)
+    }
+    if err != nil {
+        log.Println("Could not set quota overrides:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    before := make(map[string]any)
+    for dataType, quota := range previous {
+        before[dataType] = quota
+    }
+    after := make(map[string]any)
+    for dataType, quota := range overrides {
+        after[dataType] = quota
+    }
+    s.appendAudit(r.Context(), store.AuditEntry{
+        ActorId: ownerId,
+        SubjectId: userId,
+        Action: auditSetQuotas,
+        DataType: types.User{}.TypeString(),
+        RecordId: userId,
+        Diff: auditDiff(before, after),
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(overrides)
+}
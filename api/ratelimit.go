@@ -0,0 +1,101 @@
+package api
+
+import (
+    "net/http"
+    "strconv"
+    "math"
+    "sync"
+    "time"
+    "log"
+
+    "github.com/reshane/glonk/store"
+)
+
+// takes a token from the bucket at key, reporting how long until one is available when it's empty
+type Limiter interface {
+    Take(key string, limit store.RateLimit) (bool, time.Duration, error)
+}
+
+// buckets idle this long are dropped, they've refilled by then for any sensible limit
+const bucketIdleTimeout = time.Hour
+
+// token buckets held by this server, for single instance deployments
+type memoryLimiter struct {
+    mu sync.Mutex
+    buckets map[string]store.Bucket
+    swept time.Time
+}
+
+func NewMemoryLimiter() Limiter {
+    return &memoryLimiter{ buckets: make(map[string]store.Bucket), swept: time.Now() }
+}
+
+func (l *memoryLimiter) Take(key string, limit store.RateLimit) (bool, time.Duration, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    if now.Sub(l.swept) > bucketIdleTimeout {
+        for k, bucket := range l.buckets {
+            if now.Sub(bucket.Updated) > bucketIdleTimeout {
+                delete(l.buckets, k)
+            }
+        }
+        l.swept = now
+    }
+    bucket, exists := l.buckets[key]
+    if !exists {
+        bucket = store.NewBucket(limit, now)
+    }
+    bucket, allowed, wait := bucket.Take(limit, now)
+    l.buckets[key] = bucket
+    return allowed, wait, nil
+}
+
+// token buckets kept in the store, shared by every server using it
+type storeLimiter struct {
+    db store.Store
+}
+
+func NewStoreLimiter(db store.Store) Limiter {
+    return &storeLimiter{ db: db }
+}
+
+func (l *storeLimiter) Take(key string, limit store.RateLimit) (bool, time.Duration, error) {
+    return l.db.TakeToken(key, limit)
+}
+
+func isRead(r *http.Request) bool {
+    return r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+}
+
+// limits each session, or client ip without one, to separate read and write budgets
+// a zero rate disables that budget. requests over budget get a 429 with Retry-After
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        kind, limit := "write", s.writeLimit
+        if isRead(r) {
+            kind, limit = "read", s.readLimit
+        }
+        if s.limiter == nil || limit.Rate <= 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        key := kind + ":ip:" + clientIp(r)
+        if ownerId, ok := sessionOwnerId(r); ok {
+            key = kind + ":user:" + strconv.FormatInt(ownerId, 10)
+        }
+        allowed, wait, err := s.limiter.Take(key, limit)
+        if err != nil {
+            // an unavailable limiter shouldn't take the api down with it
+            log.Println("Could not rate limit request:", err)
+            next.ServeHTTP(w, r)
+            return
+        }
+        if !allowed {
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+            http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
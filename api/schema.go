@@ -0,0 +1,94 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "sort"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// json schema for a column, annotated with its go type, glonk column and roles
+func columnSchema(col store.Column) map[string]any {
+    schema := fieldSchema(col.Field.Type)
+    if nullable, _ := schema["nullable"].(bool); nullable {
+        delete(schema, "nullable")
+        schema["type"] = []any{schema["type"], "null"}
+    }
+    schema["goType"] = col.Field.Type.String()
+    schema["column"] = col.Name
+    if len(col.Roles) > 0 {
+        schema["roles"] = col.Roles
+    }
+    if col.Managed {
+        schema["readOnly"] = true
+    }
+    if col.Visibility != store.Public {
+        schema["visibility"] = col.Visibility
+    }
+    if types.FieldConstraints(col.Field).Required && schema["type"] == "string" {
+        schema["minLength"] = 1
+    }
+    return schema
+}
+
+// json schema document describing a data type's records and the queries accepted for them
+func typeSchema(dataType string, metaData types.MetaData) map[string]any {
+    properties := make(map[string]any)
+    required := make([]string, 0)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if col.Visibility == store.ServerOnly {
+            continue
+        }
+        properties[col.JsonName] = columnSchema(col)
+        if types.FieldConstraints(col.Field).Required {
+            required = append(required, col.JsonName)
+        }
+    }
+
+    builders := metaData.GetQueries()
+    names := make([]string, 0, len(builders))
+    for name := range builders {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    queries := make([]any, 0)
+    for _, name := range names {
+        queries = append(queries, map[string]any{
+            "name": name,
+            "field": builders[name].Field,
+            "format": builders[name].Format,
+        })
+    }
+
+    ownership := "public"
+    if store.IsPrivate(metaData) {
+        ownership = "private"
+    }
+    return map[string]any{
+        "$schema": jsonSchemaDialect,
+        "title": metaData.GetType().Name(),
+        "type": "object",
+        "properties": properties,
+        "required": required,
+        "table": metaData.TableName(),
+        "ownership": ownership,
+        "queries": queries,
+    }
+}
+
+// json schema for every registered data type, keyed by data type
+func (s *Server) schema(w http.ResponseWriter, r *http.Request) {
+    schemas := make(map[string]any)
+    for dataType, metaData := range types.MetaDataMap {
+        schemas[dataType] = typeSchema(dataType, metaData)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(schemas); err != nil {
+        log.Println("Could not encode schema:", err)
+    }
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+    "net/http"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "sort"
+    "html"
+    "fmt"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+const (
+    defaultSearchLimit = 20
+    maxSearchLimit = 100
+)
+
+type searchHit struct {
+    Type string `json:"type"`
+    Rank float64 `json:"rank"`
+    Data map[string]any `json:"data"`
+    Highlights map[string]string `json:"highlights"`
+}
+
+// escapes a highlighted fragment for html, keeping the highlight markers
+func escapeHighlight(fragment string) string {
+    escaped := html.EscapeString(fragment)
+    escaped = strings.ReplaceAll(escaped, html.EscapeString(store.HighlightStart), store.HighlightStart)
+    return strings.ReplaceAll(escaped, html.EscapeString(store.HighlightEnd), store.HighlightEnd)
+}
+
+// data types searched by a request, all searchable types unless narrowed with types=a,b
+func searchTypes(r *http.Request) (map[string]types.MetaData, error) {
+    searched := make(map[string]types.MetaData)
+    names := r.URL.Query().Get("types")
+    if names == "" {
+        for dataType, metaData := range types.MetaDataMap {
+            if store.IsSearchable(metaData) {
+                searched[dataType] = metaData
+            }
+        }
+        return searched, nil
+    }
+    for _, dataType := range strings.Split(names, ",") {
+        metaData, exists := types.MetaDataMap[dataType]
+        if !exists || !store.IsSearchable(metaData) {
+            return nil, fmt.Errorf("%s is not a searchable data type", dataType)
+        }
+        searched[dataType] = metaData
+    }
+    return searched, nil
+}
+
+// full text search across data types, ranked best first
+// private types only match the session's own records
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    q := strings.TrimSpace(r.URL.Query().Get("q"))
+    if q == "" {
+        http.Error(w, "Missing search query q", http.StatusBadRequest)
+        return
+    }
+    limit := defaultSearchLimit
+    if param := r.URL.Query().Get("limit"); param != "" {
+        limit, err = strconv.Atoi(param)
+        if err != nil || limit < 1 || limit > maxSearchLimit {
+            http.Error(w, "limit must be between 1 and " + strconv.Itoa(maxSearchLimit), http.StatusBadRequest)
+            return
+        }
+    }
+    searched, err := searchTypes(r)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    hits := make([]searchHit, 0)
+    for dataType, metaData := range searched {
+        results, err := s.db.Search(metaData, q, ownerId, limit)
+        if err != nil {
+            log.Printf("Could not search %s: %v\n", dataType, err)
+            http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+            return
+        }
+        columns := make(map[string]store.Column)
+        for _, col := range store.GetColumns(metaData.GetType()) {
+            columns[col.Name] = col
+        }
+        for _, result := range results {
+            doc, err := redact(result.Data, ownerId)
+            if err != nil {
+                log.Println("Could not encode response:", err)
+                http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+                return
+            }
+            // highlights of redacted fields would leak them
+            highlights := make(map[string]string)
+            for col, fragment := range result.Highlights {
+                jsonName := columns[col].JsonName
+                if _, visible := doc[jsonName]; visible {
+                    highlights[jsonName] = escapeHighlight(fragment)
+                }
+            }
+            hits = append(hits, searchHit{
+                Type: dataType,
+                Rank: result.Rank,
+                Data: doc,
+                Highlights: highlights,
+            })
+        }
+    }
+    sort.SliceStable(hits, func(i, j int) bool {
+        return hits[i].Rank > hits[j].Rank
+    })
+    if len(hits) > limit {
+        hits = hits[:limit]
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "private, no-cache")
+    json.NewEncoder(w).Encode(hits)
+}
@@ -2,12 +2,16 @@ package api
 
 import (
     "net/http"
-    "encoding/json"
     "strconv"
     "log"
     "fmt"
+    "time"
+    "errors"
+    "context"
+    "sync"
 
     "github.com/gorilla/mux"
+    "github.com/graphql-go/graphql"
 
     "github.com/reshane/glonk/store"
     "github.com/reshane/glonk/types"
@@ -16,43 +20,372 @@ import (
 type Server struct {
     listenAddr string
     db store.Store
+    httpServer *http.Server
+    // plain http listener redirecting to https, when serving tls
+    redirectServer *http.Server
+    redirectAddr string
+    tlsCertFile string
+    tlsKeyFile string
+    tlsReloadInterval time.Duration
+    readTimeout time.Duration
+    writeTimeout time.Duration
+    idleTimeout time.Duration
+    maxHeaderBytes int
+    // closed by Shutdown to stop the background purge
+    done chan struct{}
+    background sync.WaitGroup
+    shutdown sync.Once
+    trashRetention time.Duration
+    cacheMaxAge time.Duration
+    graphql graphql.Schema
+    // users who may read the whole audit log
+    admins map[int64]bool
+    limiter Limiter
+    readLimit store.RateLimit
+    writeLimit store.RateLimit
+    // storage allowed each user per data type, unless an admin overrides it
+    defaultQuota store.Quota
+    quotas map[string]store.Quota
+    quotaLocks quotaLocks
+    secureCookies bool
+    corsPolicy CorsPolicy
+    contentSecurityPolicy string
+    hstsMaxAge time.Duration
 }
 
-func NewServer(listenAddr string, db store.Store) *Server {
-    return &Server {
+// server configuration options
+type Option func(*Server)
+
+// how long soft deleted records stay in the trash before being purged
+func WithTrashRetention(retention time.Duration) Option {
+    return func(s *Server) {
+        s.trashRetention = retention
+    }
+}
+
+// how long shared caches may keep responses for public data types
+func WithCacheMaxAge(maxAge time.Duration) Option {
+    return func(s *Server) {
+        s.cacheMaxAge = maxAge
+    }
+}
+
+// users granted admin access
+func WithAdmins(ids []int64) Option {
+    return func(s *Server) {
+        for _, id := range ids {
+            s.admins[id] = true
+        }
+    }
+}
+
+// per session or client ip budgets for reads and writes, a zero rate is unlimited
+func WithRateLimits(read store.RateLimit, write store.RateLimit) Option {
+    return func(s *Server) {
+        s.readLimit = read
+        s.writeLimit = write
+    }
+}
+
+// where rate limit buckets are kept, in memory by default
+func WithLimiter(limiter Limiter) Option {
+    return func(s *Server) {
+        s.limiter = limiter
+    }
+}
+
+// storage allowed each user of every data type, zero limits are unlimited
+func WithDefaultQuota(quota store.Quota) Option {
+    return func(s *Server) {
+        s.defaultQuota = quota
+    }
+}
+
+// storage allowed each user of one data type, in place of the default quota
+func WithQuota(dataType string, quota store.Quota) Option {
+    return func(s *Server) {
+        s.quotas[dataType] = quota
+    }
+}
+
+// always mark cookies Secure, for servers behind a tls terminating proxy
+func WithSecureCookies(secure bool) Option {
+    return func(s *Server) {
+        s.secureCookies = secure
+    }
+}
+
+// which other origins may call the api from browsers, none by default
+func WithCors(policy CorsPolicy) Option {
+    return func(s *Server) {
+        s.corsPolicy = policy
+    }
+}
+
+// the Content-Security-Policy header of every response, empty to leave it out
+func WithContentSecurityPolicy(policy string) Option {
+    return func(s *Server) {
+        s.contentSecurityPolicy = policy
+    }
+}
+
+// how long browsers should only use https once they've seen it, 0 to leave out Strict-Transport-Security
+func WithHstsMaxAge(maxAge time.Duration) Option {
+    return func(s *Server) {
+        s.hstsMaxAge = maxAge
+    }
+}
+
+// how long reading a request and writing its response may take, and keep-alive
+// connections may sit idle between requests. a zero timeout is unlimited
+func WithTimeouts(read time.Duration, write time.Duration, idle time.Duration) Option {
+    return func(s *Server) {
+        s.readTimeout = read
+        s.writeTimeout = write
+        s.idleTimeout = idle
+    }
+}
+
+// the largest request line and headers accepted
+func WithMaxHeaderBytes(max int) Option {
+    return func(s *Server) {
+        s.maxHeaderBytes = max
+    }
+}
+
+// serve https with a certificate and key read from these files, re-read every interval
+// when either has changed, 0 to never reload
+func WithTLS(certFile string, keyFile string, reloadInterval time.Duration) Option {
+    return func(s *Server) {
+        s.tlsCertFile = certFile
+        s.tlsKeyFile = keyFile
+        s.tlsReloadInterval = reloadInterval
+    }
+}
+
+// also listen for plain http at addr, redirecting every request to https
+func WithHttpRedirect(addr string) Option {
+    return func(s *Server) {
+        s.redirectAddr = addr
+    }
+}
+
+func NewServer(listenAddr string, db store.Store, opts ...Option) *Server {
+    s := &Server {
         listenAddr: listenAddr,
         db: db,
+        trashRetention: 30 * 24 * time.Hour,
+        cacheMaxAge: time.Minute,
+        admins: make(map[int64]bool),
+        limiter: NewMemoryLimiter(),
+        readLimit: store.RateLimit{ Rate: 20, Burst: 100 },
+        writeLimit: store.RateLimit{ Rate: 5, Burst: 20 },
+        defaultQuota: store.Quota{ MaxRecords: 10000, MaxBytes: 10 << 20 },
+        quotas: make(map[string]store.Quota),
+        corsPolicy: DefaultCorsPolicy(),
+        contentSecurityPolicy: DefaultContentSecurityPolicy,
+        hstsMaxAge: 365 * 24 * time.Hour,
+        // long enough for an import or an export to stream
+        readTimeout: time.Minute,
+        writeTimeout: 5 * time.Minute,
+        idleTimeout: 2 * time.Minute,
+        maxHeaderBytes: 64 << 10,
+        done: make(chan struct{}),
+    }
+    for _, opt := range opts {
+        opt(s)
+    }
+    schema, err := s.graphqlSchema()
+    if err != nil {
+        log.Fatalln("Could not build graphql schema:", err)
     }
+    s.graphql = schema
+    s.httpServer = &http.Server{
+        Addr: s.listenAddr,
+        Handler: s.handler(),
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout: s.readTimeout,
+        WriteTimeout: s.writeTimeout,
+        IdleTimeout: s.idleTimeout,
+        MaxHeaderBytes: s.maxHeaderBytes,
+        Protocols: new(http.Protocols),
+    }
+    s.httpServer.Protocols.SetHTTP1(true)
+    // http/2 is negotiated over tls
+    s.httpServer.Protocols.SetHTTP2(true)
+    if s.tlsCertFile != "" && s.redirectAddr != "" {
+        s.redirectServer = s.newRedirectServer()
+    }
+    return s
 }
 
+// serves until Shutdown, when it returns nil straight away - wait for Shutdown to
+// return before exiting
 func (s *Server) Start() error {
+    s.background.Add(1)
+    go s.purgeTrash()
+    if s.tlsCertFile == "" {
+        return serveUntilShutdown(s.httpServer.ListenAndServe())
+    }
+
+    config, err := s.tlsConfig()
+    if err != nil {
+        return err
+    }
+    s.httpServer.TLSConfig = config
+    if s.redirectServer != nil {
+        go func() {
+            if err := serveUntilShutdown(s.redirectServer.ListenAndServe()); err != nil {
+                log.Println("Could not serve http redirects:", err)
+            }
+        }()
+    }
+    return serveUntilShutdown(s.httpServer.ListenAndServeTLS("", ""))
+}
+
+func serveUntilShutdown(err error) error {
+    if errors.Is(err, http.ErrServerClosed) {
+        return nil
+    }
+    return err
+}
+
+// stops accepting connections, waits for in-flight requests to finish and then closes
+// the store. connections still open when ctx is done are cut
+func (s *Server) Shutdown(ctx context.Context) error {
+    var err error
+    s.shutdown.Do(func() {
+        close(s.done)
+        if s.redirectServer != nil {
+            s.redirectServer.Shutdown(ctx)
+        }
+        err = s.httpServer.Shutdown(ctx)
+        if err != nil {
+            log.Println("Could not drain requests:", err)
+            s.httpServer.Close()
+        }
+        s.background.Wait()
+        err = errors.Join(err, s.db.Close())
+    })
+    return err
+}
+
+// the router behind the middleware that has to see every request, including those
+// no route matches like preflights
+func (s *Server) handler() http.Handler {
+    return s.securityHeaders(s.cors(s.router()))
+}
+
+func (s *Server) router() *mux.Router {
     r := mux.NewRouter()
+    r.Use(withRequestId)
+    r.Use(s.rateLimit)
+    r.Use(s.csrf)
     // data endpoints
-    r.Handle("/data/{dataType}/{id}", isAuthorized(s.handleGetByID)).
+    r.Handle("/data/{dataType}/count", isAuthorized(acceptable(s.handleCount))).
+        Methods("GET")
+    r.Handle("/data/{dataType}/aggregate", isAuthorized(acceptable(s.handleAggregate))).
+        Methods("GET")
+    r.Handle("/data/{dataType}/{id}", isAuthorized(acceptable(s.handleGetByID))).
         Methods("GET")
-    r.Handle("/data/{dataType}", isAuthorized(s.handleGetByQueries)).
+    r.Handle("/data/{dataType}", isAuthorized(acceptable(s.handleGetByQueries))).
         Methods("GET")
-    r.Handle("/data/{dataType}", isAuthorized(s.handleCreate)).
+    r.Handle("/data/{dataType}", isAuthorized(acceptable(s.handleCreate))).
         Methods("POST")
-    r.Handle("/data/{dataType}", isAuthorized(s.handleUpdate)).
+    r.Handle("/data/{dataType}", isAuthorized(acceptable(s.handleUpdate))).
         Methods("PUT")
-    r.Handle("/data/{dataType}/{id}", isAuthorized(s.handleDeleteByID)).
+    r.Handle("/data/{dataType}/{id}", isAuthorized(acceptable(s.handleUpsert))).
+        Methods("PUT")
+    r.Handle("/data/{dataType}/{id}", isAuthorized(acceptable(s.handleDeleteByID))).
         Methods("DELETE")
+    r.Handle("/data/{dataType}/{id}", isAuthorized(acceptable(s.handlePatch))).
+        Methods("PATCH")
+
+    // trash
+    r.Handle("/trash/{dataType}", isAuthorized(acceptable(s.handleGetTrash))).
+        Methods("GET")
+    r.Handle("/trash/{dataType}/{id}/restore", isAuthorized(acceptable(s.handleRestore))).
+        Methods("POST")
+    r.Handle("/trash/{dataType}/{id}", isAuthorized(acceptable(s.handlePurge))).
+        Methods("DELETE")
+
+    // search
+    r.Handle("/search", isAuthorized(s.handleSearch)).
+        Methods("GET")
+
+    // graphql
+    r.Handle("/graphql", isAuthorized(s.handleGraphql)).
+        Methods("POST")
+
+    // account
+    r.Handle("/account/export", isAuthorized(s.handleExport)).
+        Methods("GET")
+    r.Handle("/account/import", isAuthorized(s.handleImport)).
+        Methods("POST")
+    r.Handle("/account", isAuthorized(s.handleDeleteAccount)).
+        Methods("DELETE")
+    r.Handle("/account/usage", isAuthorized(s.handleUsage)).
+        Methods("GET")
+
+    // admin
+    r.Handle("/admin/quotas/{userId}", isAuthorized(s.adminOnly(s.handleGetQuotas))).
+        Methods("GET")
+    r.Handle("/admin/quotas/{userId}", isAuthorized(s.adminOnly(s.handleSetQuotas))).
+        Methods("PUT")
+
+    // audit log
+    r.Handle("/audit", isAuthorized(s.handleAudit)).
+        Methods("GET")
 
     // schema
     r.Handle("/schema", isAuthorized(s.schema)).
         Methods("GET")
 
+    // api description
+    r.HandleFunc("/openapi.json", s.handleOpenapi).
+        Methods("GET")
+
     // auth
-    r.Handle("/auth/logout", isAuthorized(s.logout))
+    r.Handle("/auth/logout", isAuthorized(s.logout)).
+        Methods("POST")
     r.HandleFunc("/auth/google/login", s.googleLogin)
     r.HandleFunc("/auth/google/callback", s.googleCallback)
 
     // static files
     r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static")))
 
-    http.Handle("/", r)
-    return http.ListenAndServe(s.listenAddr, nil)
+    return r
+}
+
+// query params handled by the endpoints rather than a data type's queries
+var reservedParams = map[string]bool {
+    "expand": true,
+    "fields": true,
+    "aggregate": true,
+    "groupBy": true,
+}
+
+// data type queries from the request's query params, unknown or malformed ones are skipped
+func queriesFromParams(r *http.Request, metaData types.MetaData) []types.Query {
+    builders := metaData.GetQueries()
+    queries := make([]types.Query, 0)
+    for k, v := range r.URL.Query() {
+        if reservedParams[k] {
+            continue
+        }
+        builder, exists := builders[k]
+        if !exists {
+            log.Printf("Could not find query %s for data type %s\n", k, metaData.GetType().Name())
+            continue
+        }
+        query, err := builder.Parser(builder.Field, v)
+        if err != nil {
+            log.Printf("Error parsing query param %s for query %s: %v\n", v, k, err)
+            continue
+        }
+        queries = append(queries, query)
+    }
+    return queries
 }
 
 func getOwnerIdFromRequestHeaders(r *http.Request) (int64, error) {
@@ -68,12 +401,86 @@ func getOwnerIdFromRequestHeaders(r *http.Request) (int64, error) {
     return ownerId, nil
 }
 
-func (s *Server) schema(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(types.MetaDataMap)
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists {
+        log.Println("No metaData for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusBadRequest)
+        return
+    }
+
+    data, ok := decodeWrite(w, r, metaData)
+    if !ok {
+        return
+    }
+    data = s.preserveServerOnly(metaData, data, ownerId)
+
+    if !validateWrite(data, ownerId, w) {
+        return
+    }
+
+    if !data.Validate() {
+        log.Println("Invalid data in update request:", data)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    version, ok := s.checkIfMatch(w, r, metaData, store.GetId(data), ownerId)
+    if !ok {
+        return
+    }
+    if version != 0 {
+        data, err = store.SetVersion(data, version)
+        if err != nil {
+            log.Println(err)
+            http.Error(w, "Bad Request", http.StatusBadRequest)
+            return
+        }
+    }
+
+    unlock, ok := s.holdQuota(w, data.TypeString(), ownerId)
+    if !ok {
+        return
+    }
+    defer unlock()
+    before := s.stored(metaData, store.GetId(data), ownerId)
+    if before != nil && !s.enforceQuota(w, metaData, ownerId, before, data, true) {
+        return
+    }
+    updated, err := s.db.Update(data)
+    if err != nil {
+        log.Println(err)
+        if errors.Is(err, store.VersionConflict{}) {
+            if r.Header.Get("If-Match") != "" {
+                http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+                return
+            }
+            http.Error(w, "Conflict", http.StatusConflict)
+            return
+        }
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    s.audit(r.Context(), ownerId, auditUpdate, before, updated)
+
+    if etag, ok := versionETag(r, updated, ownerId); ok {
+        w.Header().Set("ETag", etag)
+    }
+    writeRecord(w, r, http.StatusOK, updated, ownerId)
 }
 
-func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+// create-or-replace of the record at id
+func (s *Server) handleUpsert(w http.ResponseWriter, r *http.Request) {
     ownerId, err := getOwnerIdFromRequestHeaders(r)
     if err != nil {
         log.Println("Could not get ownerId from headers", err)
@@ -90,58 +497,128 @@ func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    data, err := metaData.GetDecoder()(r)
+    id, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil || id < 1 {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    data, ok := decodeWrite(w, r, metaData)
+    if !ok {
+        return
+    }
+    if bodyId := store.GetId(data); bodyId != 0 && bodyId != id {
+        log.Printf("Body id %d does not match path id %d\n", bodyId, id)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    data, err = store.SetId(data, id)
     if err != nil {
         log.Println(err)
         http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
+    data = s.preserveServerOnly(metaData, data, ownerId)
 
     if !validateWrite(data, ownerId, w) {
         return
     }
 
     if !data.Validate() {
-        log.Println("Invalid data in update request:", data)
+        log.Println("Invalid data in upsert request:", data)
         http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
 
-    updated, err := s.db.Update(data)
+    version, ok := s.checkIfMatch(w, r, metaData, id, ownerId)
+    if !ok {
+        return
+    }
+    if version != 0 {
+        data, err = store.SetVersion(data, version)
+        if err != nil {
+            log.Println(err)
+            http.Error(w, "Bad Request", http.StatusBadRequest)
+            return
+        }
+    }
+
+    unlock, ok := s.holdQuota(w, data.TypeString(), ownerId)
+    if !ok {
+        return
+    }
+    defer unlock()
+    before := s.stored(metaData, id, ownerId)
+    if !s.enforceQuota(w, metaData, ownerId, before, data, false) {
+        return
+    }
+    upserted, created, err := s.db.Upsert(data, "id")
     if err != nil {
-        log.Println(err)
+        log.Println("Could not upsert object:", err)
+        if errors.Is(err, store.VersionConflict{}) {
+            if r.Header.Get("If-Match") != "" {
+                http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+                return
+            }
+            http.Error(w, "Conflict", http.StatusConflict)
+            return
+        }
+        if errors.Is(err, store.UnallocatedId{}) {
+            http.Error(w, "Records can only be created at ids that have been handed out, POST to create", http.StatusNotFound)
+            return
+        }
+        if errors.Is(err, store.NoRows{}) {
+            // someone else's record, which the caller can't see any more than on GET
+            http.Error(w, "Not Found", http.StatusNotFound)
+            return
+        }
         http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(updated)
+    if created {
+        s.audit(r.Context(), ownerId, auditCreate, nil, upserted)
+    } else {
+        s.audit(r.Context(), ownerId, auditUpdate, before, upserted)
+    }
+
+    if etag, ok := versionETag(r, upserted, ownerId); ok {
+        w.Header().Set("ETag", etag)
+    }
+    status := http.StatusOK
+    if created {
+        w.Header().Set("Location", r.URL.Path)
+        status = http.StatusCreated
+    }
+    writeRecord(w, r, status, upserted, ownerId)
 }
 
 func validateWrite(data types.DataType, ownerId int64, w http.ResponseWriter) bool {
-    writerIdentifierExists := false
+    if err := checkWriter(data, ownerId); err != nil {
+        log.Println(err)
+        http.Error(w, "Not Authorized", http.StatusUnauthorized)
+        return false
+    }
+    return true
+}
+
+// checks the session's ownerId is the data's owner or author
+func checkWriter(data types.DataType, ownerId int64) error {
     dataOwnerId, err := store.GetOwnerId(data)
     if err == nil {
-        writerIdentifierExists = true
         if dataOwnerId != ownerId {
-            log.Println("Session ownerId does not match data ownerId")
-            http.Error(w, "Not Authorized", http.StatusUnauthorized)
-            return false
+            return errors.New("Session ownerId does not match data ownerId")
         }
-    }
-    if writerIdentifierExists {
-        return true
+        return nil
     }
     dataAuthorId, err := store.GetAuthorId(data)
     if err == nil {
-        writerIdentifierExists = true
         if dataAuthorId != ownerId {
-            log.Println("Session ownerId does not match data authorId")
-            http.Error(w, "Not Authorized", http.StatusUnauthorized)
-            return false
+            return errors.New("Session ownerId does not match data authorId")
         }
+        return nil
     }
-    return writerIdentifierExists
+    return errors.New("Data has no owner_id or author_id")
 }
 
 func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
@@ -161,13 +638,13 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    data, err := metaData.GetDecoder()(r)
-    if err != nil {
-        log.Println(err)
-        http.Error(w, "Bad Request", http.StatusBadRequest)
+    data, ok := decodeWrite(w, r, metaData)
+    if !ok {
         return
     }
 
+    data = withServerOnly(data, nil)
+
     if !validateWrite(data, ownerId, w) {
         log.Println("Invalid write")
         return
@@ -178,6 +655,14 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
+    unlock, ok := s.holdQuota(w, data.TypeString(), ownerId)
+    if !ok {
+        return
+    }
+    defer unlock()
+    if !s.enforceQuota(w, metaData, ownerId, nil, data, false) {
+        return
+    }
 
     created, err := s.db.Create(data)
     if err != nil {
@@ -185,9 +670,9 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
+    s.audit(r.Context(), ownerId, auditCreate, nil, created)
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(created)
+    writeRecord(w, r, http.StatusOK, created, ownerId)
 }
 
 func (s *Server) handleDeleteByID(w http.ResponseWriter, r *http.Request) {
@@ -213,15 +698,30 @@ func (s *Server) handleDeleteByID(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    version, ok := s.checkIfMatch(w, r, metaData, id, ownerId)
+    if !ok {
+        return
+    }
 
-    data, err := s.db.Delete(metaData, id, ownerId)
+    before := s.stored(metaData, id, ownerId)
+    // conditional on the If-Match version, so a write since it was checked isn't lost
+    data, err := s.db.Delete(metaData, id, ownerId, version)
+    if errors.Is(err, store.VersionConflict{}) {
+        log.Println("Version changed since If-Match was checked:", err)
+        http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+        return
+    }
     if err != nil {
         log.Println("Could not find data:", err)
         http.Error(w, "Not Found", http.StatusNotFound)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(data)
+    if store.HasTrash(metaData) {
+        s.audit(r.Context(), ownerId, auditDelete, before, data)
+    } else {
+        s.audit(r.Context(), ownerId, auditDelete, data, nil)
+    }
+    writeRecord(w, r, http.StatusOK, data, ownerId)
 }
 
 func (s *Server) handleGetByQueries(w http.ResponseWriter, r *http.Request) {
@@ -241,20 +741,27 @@ func (s *Server) handleGetByQueries(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    builders := metaData.GetQueries()
-    queries := make([]types.Query, 0)
-    for k, v := range r.URL.Query() {
-        builder, exists := builders[k]
-        if !exists {
-            log.Printf("Could not find query %s for data type %s\n", k, dataType)
-            continue
-        }
-        query, err := builder.Parser(builder.Field, v)
-        if err != nil {
-            log.Printf("Error parsing query param %s for query %s: %v\n", v, k, err)
-            continue
-        }
-        queries = append(queries, query)
+    queries := queriesFromParams(r, metaData)
+
+    fields, err := fieldsParam(r, metaData)
+    if err != nil {
+        log.Println(err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    columns, err := projectedColumns(metaData, fields, expandParam(r))
+    if err != nil {
+        log.Println(err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    if len(columns) > 0 {
+        queries = append(queries, types.NewProjection(columns))
+    }
+
+    if f := responseFormat(r); f.stream != nil && len(expandParam(r)) == 0 {
+        s.streamRecords(w, r, f, metaData, queries, fields, ownerId)
+        return
     }
 
     data, err := s.db.GetByQueries(metaData, queries, ownerId)
@@ -263,8 +770,13 @@ func (s *Server) handleGetByQueries(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Not Found", http.StatusNotFound)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(data)
+    docs, err := s.render(r, metaData, data, ownerId)
+    if err != nil {
+        log.Println("Could not render data:", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    s.writeCacheable(w, r, metaData, "", nil, docs)
 }
 
 func (s *Server) handleGetByID(w http.ResponseWriter, r *http.Request) {
@@ -291,12 +803,52 @@ func (s *Server) handleGetByID(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    data, err := s.db.Get(metaData, id, ownerId)
+    fields, err := fieldsParam(r, metaData)
     if err != nil {
-        log.Println("Could not find data:", err)
-        http.Error(w, "Not Found", http.StatusNotFound)
+        log.Println(err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+    expand := expandParam(r)
+
+    var data types.DataType
+    if len(fields) > 0 {
+        columns, err := projectedColumns(metaData, fields, expand)
+        if err != nil {
+            log.Println(err)
+            http.Error(w, "Bad Request", http.StatusBadRequest)
+            return
+        }
+        queries := []types.Query{ types.NewById("id", []int64{id}), types.NewProjection(columns) }
+        found, err := s.db.GetByQueries(metaData, queries, ownerId)
+        if err == nil && len(found) == 0 {
+            err = store.NoRows{}
+        }
+        if err != nil {
+            log.Println("Could not find data:", err)
+            http.Error(w, "Not Found", http.StatusNotFound)
+            return
+        }
+        data = found[0]
+    } else {
+        data, err = s.db.Get(metaData, id, ownerId)
+        if err != nil {
+            log.Println("Could not find data:", err)
+            http.Error(w, "Not Found", http.StatusNotFound)
+            return
+        }
+    }
+
+    docs, err := s.render(r, metaData, []types.DataType{data}, ownerId)
+    if err != nil {
+        log.Println("Could not render data:", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(data)
+    // the version doesn't cover expanded records or partial representations
+    etag := ""
+    if len(fields) == 0 && len(expand) == 0 {
+        etag, _ = versionETag(r, data, ownerId)
+    }
+    s.writeCacheable(w, r, metaData, etag, data, docs[0])
 }
@@ -0,0 +1,129 @@
+package api
+
+import (
+    "net/http"
+    "crypto/tls"
+    "net"
+    "sync"
+    "time"
+    "os"
+    "log"
+)
+
+// serves a certificate and key pair from disk, re-reading them when either file changes
+type certReloader struct {
+    certFile string
+    keyFile string
+    mu sync.RWMutex
+    cert *tls.Certificate
+    certModified time.Time
+    keyModified time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+    c := &certReloader{ certFile: certFile, keyFile: keyFile }
+    if _, err := c.reload(); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// loads the pair when either file has been modified since it was last loaded
+func (c *certReloader) reload() (bool, error) {
+    certInfo, err := os.Stat(c.certFile)
+    if err != nil {
+        return false, err
+    }
+    keyInfo, err := os.Stat(c.keyFile)
+    if err != nil {
+        return false, err
+    }
+    c.mu.RLock()
+    unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certModified) && keyInfo.ModTime().Equal(c.keyModified)
+    c.mu.RUnlock()
+    if unchanged {
+        return false, nil
+    }
+    cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+    if err != nil {
+        return false, err
+    }
+    c.mu.Lock()
+    c.cert = &cert
+    c.certModified = certInfo.ModTime()
+    c.keyModified = keyInfo.ModTime()
+    c.mu.Unlock()
+    return true, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.cert, nil
+}
+
+// polls the certificate files until the server shuts down. a pair that fails to load,
+// like one caught half written, is retried next time while the old one keeps serving
+func (s *Server) watchCertificate(c *certReloader) {
+    defer s.background.Done()
+    ticker := time.NewTicker(s.tlsReloadInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-s.done:
+            return
+        }
+        reloaded, err := c.reload()
+        if err != nil {
+            log.Println("Could not reload tls certificate:", err)
+        } else if reloaded {
+            log.Println("Reloaded tls certificate from", c.certFile)
+        }
+    }
+}
+
+// the https listener's tls config, with a certificate that follows the files on disk
+func (s *Server) tlsConfig() (*tls.Config, error) {
+    reloader, err := newCertReloader(s.tlsCertFile, s.tlsKeyFile)
+    if err != nil {
+        return nil, err
+    }
+    if s.tlsReloadInterval > 0 {
+        s.background.Add(1)
+        go s.watchCertificate(reloader)
+    }
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        GetCertificate: reloader.GetCertificate,
+    }, nil
+}
+
+// sends plain http requests to the same path on the https listener
+func (s *Server) redirectToHttps(w http.ResponseWriter, r *http.Request) {
+    host, _, err := net.SplitHostPort(r.Host)
+    if err != nil {
+        host = r.Host
+    }
+    if _, port, err := net.SplitHostPort(s.listenAddr); err == nil && port != "443" {
+        host = net.JoinHostPort(host, port)
+    }
+    status := http.StatusMovedPermanently
+    if !isSafeMethod(r.Method) {
+        // keep the method and body
+        status = http.StatusPermanentRedirect
+    }
+    http.Redirect(w, r, "https://" + host + r.URL.RequestURI(), status)
+}
+
+func (s *Server) newRedirectServer() *http.Server {
+    return &http.Server{
+        Addr: s.redirectAddr,
+        Handler: http.HandlerFunc(s.redirectToHttps),
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout: 10 * time.Second,
+        WriteTimeout: 10 * time.Second,
+        IdleTimeout: s.idleTimeout,
+        MaxHeaderBytes: s.maxHeaderBytes,
+    }
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+    "net/http"
+    "strconv"
+    "log"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// how often expired trash is purged
+const trashPurgeInterval = time.Hour
+
+func (s *Server) purgeTrash() {
+    defer s.background.Done()
+    ticker := time.NewTicker(trashPurgeInterval)
+    defer ticker.Stop()
+    for {
+        deletedBefore := time.Now().Add(-s.trashRetention)
+        for dataType, metaData := range types.MetaDataMap {
+            if !store.HasTrash(metaData) {
+                continue
+            }
+            purged, err := s.db.PurgeExpired(metaData, deletedBefore)
+            if err != nil {
+                log.Printf("Could not purge trash for %s: %v\n", dataType, err)
+                continue
+            }
+            if purged > 0 {
+                log.Printf("Purged %d %s entries from trash\n", purged, dataType)
+            }
+        }
+        purged, err := s.db.PurgeAccounts(deletedBefore)
+        if err != nil {
+            log.Println("Could not purge deleted accounts:", err)
+        } else if purged > 0 {
+            log.Printf("Purged %d deleted accounts\n", purged)
+        }
+        pruned, err := s.db.PruneRateLimits(time.Now().Add(-bucketIdleTimeout))
+        if err != nil {
+            log.Println("Could not prune rate limits:", err)
+        } else if pruned > 0 {
+            log.Printf("Pruned %d idle rate limit buckets\n", pruned)
+        }
+        select {
+        case <-ticker.C:
+        case <-s.done:
+            return
+        }
+    }
+}
+
+func (s *Server) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists || !store.HasTrash(metaData) {
+        log.Println("No trash for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+
+    data, err := s.db.GetDeleted(metaData, ownerId)
+    if err != nil {
+        log.Println("Could not find data:", err)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+    writeRecords(w, r, metaData, data, ownerId)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists || !store.HasTrash(metaData) {
+        log.Println("No trash for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+
+    id, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    data, err := s.db.Restore(metaData, id, ownerId)
+    if err != nil {
+        log.Println("Could not restore data:", err)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+    s.audit(r.Context(), ownerId, auditRestore, nil, data)
+    writeRecord(w, r, http.StatusOK, data, ownerId)
+}
+
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+    ownerId, err := getOwnerIdFromRequestHeaders(r)
+    if err != nil {
+        log.Println("Could not get ownerId from headers", err)
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    vars := mux.Vars(r)
+    dataType := vars["dataType"]
+    metaData, exists := types.MetaDataMap[dataType]
+    if !exists || !store.HasTrash(metaData) {
+        log.Println("No trash for specified data type:", dataType)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+
+    id, err := strconv.ParseInt(vars["id"], 10, 64)
+    if err != nil {
+        http.Error(w, "Bad Request", http.StatusBadRequest)
+        return
+    }
+
+    data, err := s.db.Purge(metaData, id, ownerId)
+    if err != nil {
+        log.Println("Could not purge data:", err)
+        http.Error(w, "Not Found", http.StatusNotFound)
+        return
+    }
+    s.audit(r.Context(), ownerId, auditPurge, data, nil)
+    writeRecord(w, r, http.StatusOK, data, ownerId)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+    "net/http"
+    "reflect"
+    "slices"
+    "strings"
+    "fmt"
+    "log"
+
+    "github.com/reshane/glonk/store"
+    "github.com/reshane/glonk/types"
+)
+
+// json document of a record as seen by viewerId
+// server_only fields are never sent, owner_only fields only to the record's owner or author
+func redact(record types.DataType, viewerId int64) (map[string]any, error) {
+    doc, err := toDocument(record)
+    if err != nil {
+        return nil, err
+    }
+    obj, ok := doc.(map[string]any)
+    if !ok {
+        return nil, fmt.Errorf("%s does not encode to an object", reflect.TypeOf(record).Name())
+    }
+    writerId, err := store.GetWriterId(record)
+    owns := err == nil && writerId == viewerId
+    for _, col := range store.GetColumns(reflect.TypeOf(record)) {
+        if col.Visibility == store.ServerOnly || (col.Visibility == store.OwnerOnly && !owns) {
+            delete(obj, col.JsonName)
+        }
+    }
+    return obj, nil
+}
+
+func redactAll(records []types.DataType, viewerId int64) ([]map[string]any, error) {
+    docs := make([]map[string]any, 0, len(records))
+    for _, record := range records {
+        doc, err := redact(record, viewerId)
+        if err != nil {
+            return nil, err
+        }
+        docs = append(docs, doc)
+    }
+    return docs, nil
+}
+
+// glonk columns requested with fields=a,b or fields=a&fields=b
+func fieldsParam(r *http.Request, metaData types.MetaData) ([]string, error) {
+    columns := make(map[string]store.Column)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        columns[col.Name] = col
+    }
+    names := make([]string, 0)
+    for _, param := range r.URL.Query()["fields"] {
+        for _, name := range strings.Split(param, ",") {
+            if name == "" {
+                continue
+            }
+            col, exists := columns[name]
+            if !exists || col.Visibility == store.ServerOnly {
+                return nil, fmt.Errorf("%s has no field %s", metaData.GetType().Name(), name)
+            }
+            names = append(names, name)
+        }
+    }
+    return names, nil
+}
+
+// keeps the id, the requested columns and any expanded relations
+func project(docs []map[string]any, metaData types.MetaData, fields []string, expanded []string) {
+    keep := map[string]bool{}
+    for _, name := range expanded {
+        keep[name] = true
+    }
+    requested := map[string]bool{}
+    for _, field := range fields {
+        requested[field] = true
+    }
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if requested[col.Name] || col.Name == "id" {
+            keep[col.JsonName] = true
+        }
+    }
+    for _, doc := range docs {
+        for key := range doc {
+            if !keep[key] {
+                delete(doc, key)
+            }
+        }
+    }
+}
+
+// columns the store has to select to answer a projected, expanded request. the writer
+// is always selected for redact to tell owners apart and updated_at for Last-Modified,
+// project drops them again when they weren't asked for
+func projectedColumns(metaData types.MetaData, fields []string, expand []string) ([]string, error) {
+    if len(fields) == 0 {
+        return nil, nil
+    }
+    relations, err := store.GetRelations(metaData.GetType())
+    if err != nil {
+        return nil, err
+    }
+    columns := append([]string{}, fields...)
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if col.Name == "updated_at" || slices.Contains(col.Roles, "owner_id") || slices.Contains(col.Roles, "author_id") {
+            columns = append(columns, col.Name)
+        }
+    }
+    for _, name := range expand {
+        for _, relation := range relations {
+            if relation.Name == name {
+                columns = append(columns, relation.LocalCol)
+            }
+        }
+    }
+    return columns, nil
+}
+
+// redacts, expands and projects records for a GET response
+func (s *Server) render(r *http.Request, metaData types.MetaData, records []types.DataType, ownerId int64) ([]map[string]any, error) {
+    docs, err := redactAll(records, ownerId)
+    if err != nil {
+        return nil, err
+    }
+    expand := expandParam(r)
+    if len(expand) > 0 {
+        if err := s.expand(metaData, records, docs, expand, ownerId); err != nil {
+            return nil, err
+        }
+    }
+    fields, err := fieldsParam(r, metaData)
+    if err != nil {
+        return nil, err
+    }
+    if len(fields) > 0 {
+        project(docs, metaData, fields, expand)
+    }
+    return docs, nil
+}
+
+// writes a record as seen by viewerId
+func writeRecord(w http.ResponseWriter, r *http.Request, status int, record types.DataType, viewerId int64) {
+    doc, err := redact(record, viewerId)
+    if err != nil {
+        log.Println("Could not encode response:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    writeFormatted(w, r, status, types.MetaDataMap[record.TypeString()], doc)
+}
+
+func writeRecords(w http.ResponseWriter, r *http.Request, metaData types.MetaData, records []types.DataType, viewerId int64) {
+    docs, err := redactAll(records, viewerId)
+    if err != nil {
+        log.Println("Could not encode response:", err)
+        http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+        return
+    }
+    writeFormatted(w, r, http.StatusOK, metaData, docs)
+}
+
+func hasServerOnly(metaData types.MetaData) bool {
+    for _, col := range store.GetColumns(metaData.GetType()) {
+        if col.Visibility == store.ServerOnly {
+            return true
+        }
+    }
+    return false
+}
+
+// clients can neither see nor write server_only fields, so writes carry them over
+// from the stored record, or zero them when there is none
+func withServerOnly(data types.DataType, stored types.DataType) types.DataType {
+    val := reflect.New(reflect.TypeOf(data)).Elem()
+    val.Set(reflect.ValueOf(data))
+    for _, col := range store.GetColumns(val.Type()) {
+        if col.Visibility != store.ServerOnly {
+            continue
+        }
+        field := val.FieldByIndex(col.Field.Index)
+        if stored != nil && reflect.TypeOf(stored) == val.Type() {
+            field.Set(reflect.ValueOf(stored).FieldByIndex(col.Field.Index))
+        } else {
+            field.Set(reflect.Zero(field.Type()))
+        }
+    }
+    return val.Interface().(types.DataType)
+}
+
+// fills server_only fields of an update from the stored record
+func (s *Server) preserveServerOnly(metaData types.MetaData, data types.DataType, ownerId int64) types.DataType {
+    if !hasServerOnly(metaData) {
+        return data
+    }
+    stored, err := s.db.Get(metaData, store.GetId(data), ownerId)
+    if err != nil {
+        return withServerOnly(data, nil)
+    }
+    return withServerOnly(data, stored)
+}
@@ -50,20 +50,34 @@ func main() {
         if err != nil {
             log.Fatal(err);
         }
-        contents, err := ReadToString("./db/scripts/bootstrap_sqlite.sql")
-        if err != nil {
+        runSqliteScript(conn, "./db/scripts/bootstrap_sqlite.sql")
+        // fts5 is only compiled into sqlite with -tags sqlite_fts5, search falls back to like without it
+        var hasFts5 bool
+        if err := conn.QueryRow("select sqlite_compileoption_used('ENABLE_FTS5')").Scan(&hasFts5); err != nil {
             log.Fatal(err)
         }
-        migrations := strings.Split(contents, "-- @COMMAND")
-        for _, migration := range migrations {
-            log.Println(migration);
-            if len(migration) == 0 {
-                continue
-            }
-            _, err := conn.Exec(migration)
-            if err != nil {
-                log.Fatal(err)
-            }
+        if hasFts5 {
+            runSqliteScript(conn, "./db/scripts/bootstrap_sqlite_fts.sql")
+        } else {
+            log.Println("Sqlite was built without fts5, search will use like. Build with -tags sqlite_fts5 for full text search")
+        }
+    }
+}
+
+func runSqliteScript(conn *sql.DB, path string) {
+    contents, err := ReadToString(path)
+    if err != nil {
+        log.Fatal(err)
+    }
+    migrations := strings.Split(contents, "-- @COMMAND")
+    for _, migration := range migrations {
+        log.Println(migration);
+        if len(migration) == 0 {
+            continue
+        }
+        _, err := conn.Exec(migration)
+        if err != nil {
+            log.Fatal(err)
         }
     }
 }
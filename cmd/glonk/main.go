@@ -2,7 +2,15 @@ package main
 
 import (
     "log"
+    "os"
+    "context"
+    "syscall"
+    "os/signal"
     "flag"
+    "time"
+    "strings"
+    "strconv"
+    "slices"
 
     "github.com/reshane/glonk/api"
     "github.com/reshane/glonk/store"
@@ -15,17 +23,132 @@ func getDb(which string) (store.Store, error) {
 	return store.NewSqliteStore()
 }
 
+// user ids from a comma separated list
+func parseIds(list string) ([]int64, error) {
+    ids := make([]int64, 0)
+    for _, idString := range strings.Split(list, ",") {
+        if idString == "" {
+            continue
+        }
+        id, err := strconv.ParseInt(strings.TrimSpace(idString), 10, 64)
+        if err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, nil
+}
+
+// non empty items of a comma separated list
+func splitList(list string) []string {
+    items := make([]string, 0)
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
 func main() {
 	listenAddr := flag.String("listenaddr", ":8080", "The server address (default :8080)")
 	whichDb := flag.String("storage", "sqlite3", "The data storeage to use - psql: Postgres, sqlite3: Sqlite3 (default)")
+	trashRetention := flag.Duration("trashretention", 30 * 24 * time.Hour, "How long deleted data stays in the trash before being purged (default 720h)")
+	cacheMaxAge := flag.Duration("cachemaxage", time.Minute, "How long shared caches may keep public data (default 1m)")
+	adminList := flag.String("admins", "", "Comma separated ids of users who may read the whole audit log and set quotas")
+	readRate := flag.Float64("readrate", 20, "Reads per second allowed each user or client ip, 0 for unlimited (default 20)")
+	readBurst := flag.Int("readburst", 100, "Reads allowed in a burst (default 100)")
+	writeRate := flag.Float64("writerate", 5, "Writes per second allowed each user or client ip, 0 for unlimited (default 5)")
+	writeBurst := flag.Int("writeburst", 20, "Writes allowed in a burst (default 20)")
+	maxRecords := flag.Int64("maxrecords", 10000, "Records of each data type allowed each user, 0 for unlimited (default 10000)")
+	maxBytes := flag.Int64("maxbytes", 10 << 20, "Bytes of each data type allowed each user, 0 for unlimited (default 10MiB)")
+	secureCookies := flag.Bool("securecookies", false, "Mark cookies Secure on plain http too, for servers behind a tls terminating proxy")
+	corsOrigins := flag.String("corsorigins", "", "Comma separated origins whose pages may call the api, * for any without -corscredentials (default none)")
+	corsMethods := flag.String("corsmethods", "GET,HEAD,POST,PUT,PATCH,DELETE", "Comma separated methods other origins may use")
+	corsCredentials := flag.Bool("corscredentials", false, "Send the session cookie with requests from -corsorigins")
+	corsMaxAge := flag.Duration("corsmaxage", 10 * time.Minute, "How long browsers may cache a preflight (default 10m)")
+	csp := flag.String("csp", api.DefaultContentSecurityPolicy, "The Content-Security-Policy header, empty to leave it out")
+	hstsMaxAge := flag.Duration("hstsmaxage", 365 * 24 * time.Hour, "Strict-Transport-Security max age over https, 0 to leave it out (default 8760h)")
+	readTimeout := flag.Duration("readtimeout", time.Minute, "How long reading a request may take, 0 for unlimited (default 1m)")
+	writeTimeout := flag.Duration("writetimeout", 5 * time.Minute, "How long writing a response may take, 0 for unlimited (default 5m)")
+	idleTimeout := flag.Duration("idletimeout", 2 * time.Minute, "How long keep-alive connections may sit idle (default 2m)")
+	maxHeaderBytes := flag.Int("maxheaderbytes", 64 << 10, "The largest request headers accepted (default 64KiB)")
+	tlsCert := flag.String("tlscert", "", "Certificate file to serve https with, plain http when empty")
+	tlsKey := flag.String("tlskey", "", "Private key file of -tlscert")
+	tlsReload := flag.Duration("tlsreload", time.Minute, "How often to check the certificate files for changes, 0 to never reload (default 1m)")
+	httpRedirect := flag.String("httpredirect", "", "Address of a plain http listener redirecting to https, like :80 (default none)")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 30 * time.Second, "How long in-flight requests get to finish on SIGTERM or interrupt (default 30s)")
+	rateLimitStore := flag.String("ratelimitstore", "memory", "Where rate limits are kept - memory: this server (default), db: the data storage, shared by every server using it")
     flag.Parse()
 
+    admins, err := parseIds(*adminList)
+    if err != nil {
+        log.Fatalf("Invalid -admins: %v", err)
+    }
+
 	db, err := getDb(*whichDb)
     if err != nil {
         log.Fatalf("Could not create db connection: %v", err)
     }
 
-    server := api.NewServer(*listenAddr, db)
+    if (*tlsCert == "") != (*tlsKey == "") {
+        log.Fatalln("Invalid -tlscert and -tlskey: both or neither must be set")
+    }
+
+    cors := api.DefaultCorsPolicy()
+    cors.Origins = splitList(*corsOrigins)
+    cors.Methods = splitList(*corsMethods)
+    cors.Credentials = *corsCredentials
+    cors.MaxAge = *corsMaxAge
+    if cors.Credentials && slices.Contains(cors.Origins, "*") {
+        log.Fatalln("Invalid -corsorigins: * can't be used with -corscredentials")
+    }
+
+    limiter := api.NewMemoryLimiter()
+    if *rateLimitStore == "db" {
+        limiter = api.NewStoreLimiter(db)
+    }
+
+    server := api.NewServer(
+        *listenAddr,
+        db,
+        api.WithTrashRetention(*trashRetention),
+        api.WithCacheMaxAge(*cacheMaxAge),
+        api.WithAdmins(admins),
+        api.WithLimiter(limiter),
+        api.WithRateLimits(
+            store.RateLimit{ Rate: *readRate, Burst: *readBurst },
+            store.RateLimit{ Rate: *writeRate, Burst: *writeBurst },
+        ),
+        api.WithSecureCookies(*secureCookies),
+        api.WithCors(cors),
+        api.WithContentSecurityPolicy(*csp),
+        api.WithHstsMaxAge(*hstsMaxAge),
+        api.WithTimeouts(*readTimeout, *writeTimeout, *idleTimeout),
+        api.WithMaxHeaderBytes(*maxHeaderBytes),
+        api.WithTLS(*tlsCert, *tlsKey, *tlsReload),
+        api.WithHttpRedirect(*httpRedirect),
+        api.WithDefaultQuota(store.Quota{ MaxRecords: *maxRecords, MaxBytes: *maxBytes }),
+    )
+
+    // drain and close on SIGTERM or interrupt
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+    defer stop()
+    stopped := make(chan error, 1)
+    go func() {
+        <-ctx.Done()
+        log.Println("Shutting down")
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+        defer cancel()
+        stopped <- server.Shutdown(shutdownCtx)
+    }()
+
     log.Println("Server running on port: ", *listenAddr)
-    log.Fatal(server.Start())
+    if err := server.Start(); err != nil {
+        log.Fatal(err)
+    }
+    if err := <-stopped; err != nil {
+        log.Fatalf("Could not shut down cleanly: %v", err)
+    }
+    log.Println("Server stopped")
 }
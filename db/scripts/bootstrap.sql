@@ -5,13 +5,25 @@ DROP TABLE IF EXISTS posts;
 -- @COMMAND
 DROP TABLE IF EXISTS users;
 -- @COMMAND
+DROP TABLE IF EXISTS account_deletions;
+-- @COMMAND
+DROP TABLE IF EXISTS audit_log;
+-- @COMMAND
+DROP TABLE IF EXISTS rate_limits;
+-- @COMMAND
+DROP TABLE IF EXISTS quota_overrides;
+-- @COMMAND
+DROP TABLE IF EXISTS quota_locks;
+-- @COMMAND
 -- users table
 CREATE TABLE users(
     id SERIAL PRIMARY KEY,
     guid TEXT NOT NULL,
     name TEXT,
     email TEXT,
-    picture TEXT
+    picture TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 -- @COMMAND
 CREATE UNIQUE INDEX user_guid_idx on users (guid);
@@ -20,16 +32,90 @@ CREATE UNIQUE INDEX user_guid_idx on users (guid);
 CREATE TABLE notes(
     id SERIAL PRIMARY KEY,
     owner_id INT references users(id),
-    contents TEXT
+    contents TEXT,
+    deleted_at BIGINT NOT NULL DEFAULT 0,
+    -- the account deletion that trashed the record, 0 when it wasn't
+    account_deletion_id INT NOT NULL DEFAULT 0,
+    version BIGINT NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', coalesce(contents, ''))) STORED
 );
 --@COMMAND
+CREATE INDEX notes_search_vector on notes USING GIN (search_vector);
+--@COMMAND
 CREATE INDEX notes_owner_id on notes (owner_id);
 -- @COMMAND
 -- posts table
 CREATE TABLE posts(
     id SERIAL PRIMARY KEY,
     author_id INT references users(id),
-    contents TEXT
+    contents TEXT,
+    deleted_at BIGINT NOT NULL DEFAULT 0,
+    -- the account deletion that trashed the record, 0 when it wasn't
+    account_deletion_id INT NOT NULL DEFAULT 0,
+    version BIGINT NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', coalesce(contents, ''))) STORED
 );
 --@COMMAND
+CREATE INDEX posts_search_vector on posts USING GIN (search_vector);
+--@COMMAND
 CREATE INDEX posts_author_id on posts (author_id);
+-- @COMMAND
+-- account deletions, pending until purged after the grace period or restored by signing in again
+-- unix second timestamps like deleted_at, no foreign key so the record outlives the user
+CREATE TABLE account_deletions(
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    requested_at BIGINT NOT NULL,
+    restored_at BIGINT,
+    purged_at BIGINT,
+    records BIGINT NOT NULL DEFAULT 0
+);
+--@COMMAND
+CREATE INDEX account_deletions_user_id on account_deletions (user_id);
+-- @COMMAND
+-- append-only audit log of writes, logins and logouts
+CREATE TABLE audit_log(
+    id BIGSERIAL PRIMARY KEY,
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor_id INT NOT NULL,
+    subject_id INT NOT NULL,
+    action TEXT NOT NULL,
+    data_type TEXT NOT NULL DEFAULT '',
+    record_id BIGINT NOT NULL DEFAULT 0,
+    diff JSONB,
+    ip TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT ''
+);
+--@COMMAND
+CREATE INDEX audit_log_subject_id on audit_log (subject_id);
+--@COMMAND
+CREATE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING;
+--@COMMAND
+CREATE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING;
+-- @COMMAND
+-- token buckets shared by servers using the store for rate limiting, updated_at in unix microseconds
+CREATE TABLE rate_limits(
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+-- @COMMAND
+-- per user quotas set by admins in place of the server's defaults, 0 is unlimited
+CREATE TABLE quota_overrides(
+    user_id INT NOT NULL,
+    data_type TEXT NOT NULL,
+    max_records BIGINT NOT NULL DEFAULT 0,
+    max_bytes BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, data_type)
+);
+-- @COMMAND
+-- leases on each user's quota of a data type, so servers sharing the store check and write one at a time. expires_at in unix microseconds
+CREATE TABLE quota_locks(
+    key TEXT PRIMARY KEY,
+    holder TEXT NOT NULL,
+    expires_at BIGINT NOT NULL
+);
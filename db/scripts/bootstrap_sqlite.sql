@@ -1,25 +1,109 @@
 -- @COMMAND
+DROP TABLE IF EXISTS posts_fts;
+-- @COMMAND
+DROP TABLE IF EXISTS notes_fts;
+-- @COMMAND
 DROP TABLE IF EXISTS posts;
 -- @COMMAND
 DROP TABLE IF EXISTS notes;
 -- @COMMAND
 DROP TABLE IF EXISTS users;
 -- @COMMAND
+DROP TABLE IF EXISTS account_deletions;
+-- @COMMAND
+DROP TABLE IF EXISTS audit_log;
+-- @COMMAND
+DROP TABLE IF EXISTS rate_limits;
+-- @COMMAND
+DROP TABLE IF EXISTS quota_overrides;
+-- @COMMAND
+DROP TABLE IF EXISTS quota_locks;
+-- @COMMAND
 CREATE TABLE users (
     id integer primary key autoincrement,
     guid text not null,
     name text,
     email text,
-    picture text);
+    picture text,
+    created_at datetime,
+    updated_at datetime);
+-- @COMMAND
+CREATE UNIQUE INDEX user_guid_idx on users (guid);
 -- @COMMAND
 CREATE TABLE notes (
     id integer primary key autoincrement,
     owner_id integer,
     contents text,
+    deleted_at integer not null default 0,
+    -- the account deletion that trashed the record, 0 when it wasn't
+    account_deletion_id integer not null default 0,
+    version integer not null default 1,
+    created_at datetime,
+    updated_at datetime,
     foreign key(owner_id) references users(id));
 -- @COMMAND
 CREATE TABLE posts (
     id integer primary key autoincrement,
     author_id integer,
     contents text,
+    deleted_at integer not null default 0,
+    -- the account deletion that trashed the record, 0 when it wasn't
+    account_deletion_id integer not null default 0,
+    version integer not null default 1,
+    created_at datetime,
+    updated_at datetime,
     foreign key(author_id) references users(id));
+-- @COMMAND
+-- account deletions, pending until purged after the grace period or restored by signing in again
+CREATE TABLE account_deletions (
+    id integer primary key autoincrement,
+    user_id integer not null,
+    requested_at integer not null,
+    restored_at integer,
+    purged_at integer,
+    records integer not null default 0);
+-- @COMMAND
+CREATE INDEX account_deletions_user_id on account_deletions (user_id);
+-- @COMMAND
+-- append-only audit log of writes, logins and logouts
+CREATE TABLE audit_log (
+    id integer primary key autoincrement,
+    at datetime not null,
+    actor_id integer not null,
+    subject_id integer not null,
+    action text not null,
+    data_type text not null default '',
+    record_id integer not null default 0,
+    diff text,
+    ip text not null default '',
+    request_id text not null default '');
+-- @COMMAND
+CREATE INDEX audit_log_subject_id on audit_log (subject_id);
+-- @COMMAND
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+-- @COMMAND
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append only');
+END;
+-- @COMMAND
+-- token buckets shared by servers using the store for rate limiting, updated_at in unix microseconds
+CREATE TABLE rate_limits (
+    key text primary key,
+    tokens real not null,
+    updated_at integer not null);
+-- @COMMAND
+-- per user quotas set by admins in place of the server's defaults, 0 is unlimited
+CREATE TABLE quota_overrides (
+    user_id integer not null,
+    data_type text not null,
+    max_records integer not null default 0,
+    max_bytes integer not null default 0,
+    primary key (user_id, data_type));
+-- @COMMAND
+-- leases on each user's quota of a data type, so servers sharing the store check and write one at a time. expires_at in unix microseconds
+CREATE TABLE quota_locks (
+    key text primary key,
+    holder text not null,
+    expires_at integer not null);
@@ -0,0 +1,32 @@
+-- full text indexes over the searchable columns, only run by bootstrap when sqlite is built
+-- with -tags sqlite_fts5. without them search falls back to like
+-- @COMMAND
+CREATE VIRTUAL TABLE notes_fts USING fts5(contents, content='notes', content_rowid='id');
+-- @COMMAND
+CREATE TRIGGER notes_fts_insert AFTER INSERT ON notes BEGIN
+    INSERT INTO notes_fts(rowid, contents) VALUES (new.id, new.contents);
+END;
+-- @COMMAND
+CREATE TRIGGER notes_fts_delete AFTER DELETE ON notes BEGIN
+    INSERT INTO notes_fts(notes_fts, rowid, contents) VALUES ('delete', old.id, old.contents);
+END;
+-- @COMMAND
+CREATE TRIGGER notes_fts_update AFTER UPDATE OF contents ON notes BEGIN
+    INSERT INTO notes_fts(notes_fts, rowid, contents) VALUES ('delete', old.id, old.contents);
+    INSERT INTO notes_fts(rowid, contents) VALUES (new.id, new.contents);
+END;
+-- @COMMAND
+CREATE VIRTUAL TABLE posts_fts USING fts5(contents, content='posts', content_rowid='id');
+-- @COMMAND
+CREATE TRIGGER posts_fts_insert AFTER INSERT ON posts BEGIN
+    INSERT INTO posts_fts(rowid, contents) VALUES (new.id, new.contents);
+END;
+-- @COMMAND
+CREATE TRIGGER posts_fts_delete AFTER DELETE ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, contents) VALUES ('delete', old.id, old.contents);
+END;
+-- @COMMAND
+CREATE TRIGGER posts_fts_update AFTER UPDATE OF contents ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, contents) VALUES ('delete', old.id, old.contents);
+    INSERT INTO posts_fts(rowid, contents) VALUES (new.id, new.contents);
+END;
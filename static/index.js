@@ -36,7 +36,7 @@ fetch('/schema', {
 
             const queries = schemaData[dataType].queries;
             for (var qIdx = 0; qIdx < queries.length; qIdx++) {
-                const query = queries[qIdx];
+                const query = queries[qIdx].name;
                 const queryContainer = document.createElement("div");
                 queryContainer.className = dataType;
                 queryContainer.id = query;
@@ -46,6 +46,7 @@ fetch('/schema', {
                 const queryInput = document.createElement("input");
                 queryInput.type = "text";
                 queryInput.name = query;
+                queryInput.placeholder = queries[qIdx].format;
                 queryContainer.appendChild(queryLabel);
                 queryContainer.appendChild(queryInput);
                 queriesContainer.appendChild(queryContainer);
@@ -122,12 +123,37 @@ button.addEventListener('click', () => {
         });
 });
 
+// Inline handlers are blocked by the content security policy
+document.getElementById("dataTypes").addEventListener('change', () => selectDataType());
+const methodTabs = document.getElementsByClassName("tablinks");
+for (var tIdx = 0; tIdx < methodTabs.length; tIdx++) {
+    methodTabs[tIdx].addEventListener('click', (evt) => openMethod(evt, evt.currentTarget.dataset.method));
+}
+// Logout is a POST so other sites can't end the session with a link
+document.getElementById("logoutLink").addEventListener('click', (evt) => {
+    evt.preventDefault();
+    fetch('/auth/logout', {
+        method: 'POST',
+        headers: {
+            'X-CSRF-Token': getCookie("csrf_token")
+        }
+    })
+        .then(() => {
+            window.location.href = "/";
+        })
+        .catch(error => {
+            console.error('Error:', error);
+        });
+});
+
 // Request builders
 function buildRequest(requestMethod) {
     var request = {
         method: requestMethod,
         headers: {
-            'Content-Type': 'application/json'
+            'Content-Type': 'application/json',
+            // checked on writes from browsers that send neither Sec-Fetch-Site nor Origin
+            'X-CSRF-Token': getCookie("csrf_token")
         }
     };
     if (requestMethod === "POST" || requestMethod === "PUT") {
@@ -150,6 +176,17 @@ function buildUrl(method) {
     return url;
 }
 
+function getCookie(name) {
+    const cookies = document.cookie.split("; ");
+    for (var cIdx = 0; cIdx < cookies.length; cIdx++) {
+        const separator = cookies[cIdx].indexOf("=");
+        if (cookies[cIdx].substring(0, separator) === name) {
+            return decodeURIComponent(cookies[cIdx].substring(separator + 1));
+        }
+    }
+    return "";
+}
+
 // Input helpers
 function getPrimaryInput() {
     const methods = document.getElementById("requestMethodSelection");
@@ -7,6 +7,9 @@ import (
     "os"
     "errors"
     "strings"
+    "time"
+    "iter"
+    "reflect"
 
     "github.com/jackc/pgx/v5/pgxpool"
     "github.com/jackc/pgx/v5"
@@ -26,10 +29,32 @@ func NewPsqlStore() (*PsqlStore, error) {
     return &PsqlStore{ conn: conn }, nil
 }
 
-var collectors map[string]func(pgx.CollectableRow) (types.DataType, error) = map[string]func(pgx.CollectableRow) (types.DataType, error) {
-    types.UserMeta.TableName(): func (cr pgx.CollectableRow) (types.DataType, error) { res, err := pgx.RowToStructByName[types.User](cr); return res, err },
-    types.NoteMeta.TableName(): func (cr pgx.CollectableRow) (types.DataType, error) { res, err := pgx.RowToStructByName[types.Note](cr); return res, err },
-    types.PostMeta.TableName(): func (cr pgx.CollectableRow) (types.DataType, error) { res, err := pgx.RowToStructByName[types.Post](cr); return res, err },
+// row collectors for each registered data type, keyed by table name
+var collectors map[string]func(pgx.CollectableRow) (types.DataType, error) = func() map[string]func(pgx.CollectableRow) (types.DataType, error) {
+    c := make(map[string]func(pgx.CollectableRow) (types.DataType, error))
+    for _, metaData := range types.MetaDataMap {
+        c[metaData.TableName()] = rowCollector(metaData.GetType())
+    }
+    return c
+}()
+
+// scans rows through the same field conversions as the sqlite store
+func rowCollector(dt reflect.Type) func(pgx.CollectableRow) (types.DataType, error) {
+    return func(row pgx.CollectableRow) (types.DataType, error) {
+        columns := make([]string, 0)
+        for _, fd := range row.FieldDescriptions() {
+            columns = append(columns, fd.Name)
+        }
+        targetData := reflect.New(dt).Elem()
+        if err := row.Scan(scanDestinations(targetData, columns)...); err != nil {
+            return nil, err
+        }
+        data, ok := targetData.Interface().(types.DataType)
+        if !ok {
+            return nil, errors.New(dt.Name() + " is not a DataType")
+        }
+        return data, nil
+    }
 }
 
 func (s *PsqlStore) Get(metaData types.MetaData, id int64, ownerId int64) (types.DataType, error) {
@@ -48,6 +73,10 @@ func (s *PsqlStore) Get(metaData types.MetaData, id int64, ownerId int64) (types
         clauses += " and " + ownerIdCol + " = $2"
         finalArgs = append(finalArgs, ownerId)
     }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses += " and " + deletedAtCol + " = 0"
+    }
 
     query := fmt.Sprintf("select %s from %s where %s", strings.Join(fields, ","), tableName, clauses)
     rows, err := s.conn.Query(context.Background(), query, finalArgs...)
@@ -62,53 +91,54 @@ func (s *PsqlStore) Get(metaData types.MetaData, id int64, ownerId int64) (types
 }
 
 func (s *PsqlStore) GetByQueries(metaData types.MetaData, queries []types.Query, ownerId int64) ([]types.DataType, error) {
-    dataType := metaData.GetType()
-    tableName := metaData.TableName()
+    return collect(s.StreamByQueries(metaData, queries, ownerId))
+}
 
-    fields, err := intoSqlFields(dataType)
-    if err != nil {
-        log.Println("Could not retreive sql fields for ", dataType)
-        return nil, err
-    }
-    clauses := make([]string, 0)
-    finalArgs := make([]any, 0)
-    i := 1
-    for _, query := range queries {
-        // get the sql and argument map
-        clause, args := query.Sql()
-        for k, v := range args {
-            // TODO: Add a check for collisions here
-            // we can't have incompatible queries
-            named := fmt.Sprintf("@%s", k)
+func (s *PsqlStore) StreamByQueries(metaData types.MetaData, queries []types.Query, ownerId int64) iter.Seq2[types.DataType, error] {
+    return s.stream(metaData, func(placeholder func(any) string) (string, []any, error) {
+        return byQueriesSql(metaData, queries, ownerId, placeholder)
+    })
+}
+
+func (s *PsqlStore) GetReferenced(metaData types.MetaData, queries []types.Query) ([]types.DataType, error) {
+    return collect(s.stream(metaData, func(placeholder func(any) string) (string, []any, error) {
+        return referencedSql(metaData, queries, placeholder)
+    }))
+}
+
+func (s *PsqlStore) stream(metaData types.MetaData, build func(func(any) string) (string, []any, error)) iter.Seq2[types.DataType, error] {
+    return func(yield func(types.DataType, error) bool) {
+        i := 1
+        query, args, err := build(func(any) string {
             ordinal := fmt.Sprintf("$%d", i)
-            clause = strings.Replace(clause, named, ordinal, -1)
             i += 1
-            finalArgs = append(finalArgs, v)
+            return ordinal
+        })
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+        collector, exists := collectors[metaData.TableName()]
+        if !exists {
+            yield(nil, errors.New("No collector function for specified data type"))
+            return
+        }
+        rows, err := s.conn.Query(context.Background(), query, args...)
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+        defer rows.Close()
+        for rows.Next() {
+            data, err := collector(rows)
+            if !yield(data, err) || err != nil {
+                return
+            }
+        }
+        if err := rows.Err(); err != nil {
+            yield(nil, err)
         }
-        clauses = append(clauses, "(" + clause + ")")
-    }
-
-    ownerIdCol, err := getOwnerIdCol(metaData.GetType())
-    if err == nil {
-        ownerIdClause := fmt.Sprintf("%s = $%d", ownerIdCol, i)
-        clauses = append(clauses, ownerIdClause)
-        finalArgs = append(finalArgs, ownerId)
-        i += 1
-    }
-
-    query := fmt.Sprintf("select %s from %s", strings.Join(fields, ","), tableName)
-    if len(clauses) > 0 {
-        query += " where " + strings.Join(clauses, " and ")
-    }
-    rows, err := s.conn.Query(context.Background(), query, finalArgs...)
-    if err != nil {
-        return nil, err
-    }
-    collector, exists := collectors[metaData.TableName()]
-    if !exists {
-        return nil, errors.New("No collector function for specified data type")
     }
-    return pgx.CollectRows(rows, collector)
 }
 
 func (s *PsqlStore) GetByGuid(metaData types.MetaData, guid string) (types.DataType, error) {
@@ -120,6 +150,10 @@ func (s *PsqlStore) GetByGuid(metaData types.MetaData, guid string) (types.DataT
         return nil, err
     }
     query := fmt.Sprintf("select %s from %s where guid=$1", strings.Join(fields, ","), tableName)
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        query += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
     rows, err := s.conn.Query(context.Background(), query, guid)
     if err != nil {
         return nil, err
@@ -136,27 +170,23 @@ func (s *PsqlStore) Create(data types.DataType) (types.DataType, error) {
     if !exists {
         return nil, errors.New("No metadata found for specified dataType")
     }
-    dataType := metaData.GetType()
 
-    rowVals, err := intoRow(data)
+    fields, values, err := intoInsert(data)
     if err != nil {
         return nil, err
     }
-    values := rowVals[1:]
-    allFields, err := intoSqlFields(dataType)
-    if err != nil {
-        log.Println("Could not retreive sql fields for ", dataType)
-        return nil, err
-    }
-    fields := allFields[1:]
     placeholders := make([]string, 0)
     for i, _ := range fields {
         placeholders = append(placeholders, fmt.Sprintf("$%d", i + 1))
     }
     fieldString := strings.Join(fields, ",")
     placeholderString := strings.Join(placeholders, ",")
+    returning, err := intoSqlFields(metaData.GetType())
+    if err != nil {
+        return nil, err
+    }
 
-    query := fmt.Sprintf("insert into %s (%s) values (%s) returning *", metaData.TableName(), fieldString, placeholderString)
+    query := fmt.Sprintf("insert into %s (%s) values (%s) returning %s", metaData.TableName(), fieldString, placeholderString, strings.Join(returning, ","))
     rows, err := s.conn.Query(context.Background(), query, values...)
     if err != nil {
         return nil, err
@@ -167,23 +197,94 @@ func (s *PsqlStore) Create(data types.DataType) (types.DataType, error) {
         return nil, errors.New("No collector function for specified data type")
     }
     return pgx.CollectOneRow(rows, collector)
-    // TODO: this pgx functionality should be used for a CreateMany function
-    // change this to something like `insert into $1 ($2, $3...) values ($4, $5...) returning *;
-    // and use the pgx.Query() function so that we can return the new value
-    /*rows := [][]any{ dataType.IntoRow()[1:] }
-    copyCount, err := s.conn.CopyFrom(
-        context.Background(),
-        pgx.Identifier{ metaData.TableName() },
-        metaData.Fields()[1:],
-        pgx.CopyFromRows(rows),
-    )
+}
+
+// queues every insert in one batch sent inside a transaction
+func (s *PsqlStore) CreateMany(data []types.DataType) ([]types.DataType, error) {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback(ctx)
+
+    created, err := s.createInTx(ctx, tx, data)
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return nil, err
+    }
+    return created, nil
+}
+
+func (s *PsqlStore) CreateBatches(batches [][]types.DataType, prepare func(int, [][]types.DataType) error) ([][]types.DataType, error) {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
     if err != nil {
         return nil, err
     }
-    if copyCount != 1 {
-        return nil, errors.New("Could not create record")
+    defer tx.Rollback(ctx)
+
+    created := make([][]types.DataType, 0, len(batches))
+    for i, batch := range batches {
+        if err := prepare(i, created); err != nil {
+            return nil, err
+        }
+        records, err := s.createInTx(ctx, tx, batch)
+        if err != nil {
+            return nil, err
+        }
+        created = append(created, records)
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return nil, err
+    }
+    return created, nil
+}
+
+// inserts the records in one round trip, returning them in the same order
+func (s *PsqlStore) createInTx(ctx context.Context, tx pgx.Tx, data []types.DataType) ([]types.DataType, error) {
+    batch := &pgx.Batch{}
+    tableNames := make([]string, 0, len(data))
+    for _, record := range data {
+        metaData, exists := types.MetaDataMap[record.TypeString()]
+        if !exists {
+            return nil, errors.New("No metadata found for specified dataType")
+        }
+        query, values, err := insertSql(record, metaData.TableName(), func(i int) string { return fmt.Sprintf("$%d", i) })
+        if err != nil {
+            return nil, err
+        }
+        batch.Queue(query, values...)
+        tableNames = append(tableNames, metaData.TableName())
+    }
+
+    results := tx.SendBatch(ctx, batch)
+    created := make([]types.DataType, 0, len(data))
+    for _, tableName := range tableNames {
+        collector, exists := collectors[tableName]
+        if !exists {
+            results.Close()
+            log.Println("No collector function for specified table name:", tableName)
+            return nil, errors.New("No collector function for specified data type")
+        }
+        rows, err := results.Query()
+        if err != nil {
+            results.Close()
+            return nil, err
+        }
+        record, err := pgx.CollectOneRow(rows, collector)
+        if err != nil {
+            results.Close()
+            return nil, err
+        }
+        created = append(created, record)
+    }
+    if err := results.Close(); err != nil {
+        return nil, err
     }
-    return dataType, nil*/
+    return created, nil
 }
 
 func (s *PsqlStore) Update(data types.DataType) (types.DataType, error) {
@@ -214,20 +315,42 @@ func (s *PsqlStore) Update(data types.DataType) (types.DataType, error) {
             i += 1
         }
     }
+    updatedAtCol, err := getUpdatedAtCol(dataType)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = $%d", updatedAtCol, i))
+        values = append(values, now())
+        i += 1
+    }
     values = append(values, GetId(data))
-    ownerIdValue, err := GetOwnerId(data)
-    authorOwnerField := "owner_id"
+    ownerIdValue, err := GetWriterId(data)
     if err != nil {
-        ownerIdValue, err = GetAuthorId(data)
-        if err != nil {
-            return nil, err
-        }
-        authorOwnerField = "author_id"
+        return nil, err
+    }
+    authorOwnerField, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
     }
     values = append(values, ownerIdValue)
+
+    whereString := fmt.Sprintf("id = $%d and %s = $%d", i, authorOwnerField, i + 1)
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        whereString += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
+    versionChecked := false
+    versionCol, err := getVersionCol(dataType)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = %s + 1", versionCol, versionCol))
+        version, err := GetVersion(data)
+        if err == nil && version != 0 {
+            whereString += fmt.Sprintf(" and %s = $%d", versionCol, i + 2)
+            values = append(values, version)
+            versionChecked = true
+        }
+    }
     fieldSetString := strings.Join(setStrings, ", ")
 
-    query := fmt.Sprintf("update %s set %s where id = $%d and %s = $%d returning %s", tableName, fieldSetString, i, authorOwnerField, i + 1, strings.Join(fields, ","))
+    query := fmt.Sprintf("update %s set %s where %s returning %s", tableName, fieldSetString, whereString, strings.Join(fields, ","))
     rows, err := s.conn.Query(context.Background(), query, values...)
     if err != nil {
         return nil, err
@@ -237,23 +360,70 @@ func (s *PsqlStore) Update(data types.DataType) (types.DataType, error) {
         log.Println("No collector function for specified table name:", metaData.TableName())
         return nil, errors.New("No collector function for specified data type")
     }
-    return pgx.CollectOneRow(rows, collector)
+    updated, err := pgx.CollectOneRow(rows, collector)
+    if errors.Is(err, pgx.ErrNoRows) && versionChecked {
+        return nil, VersionConflict{}
+    }
+    return updated, err
 }
 
-func (s *PsqlStore) Delete(metaData types.MetaData, id int64, owner_id int64) (types.DataType, error) {
+func (s *PsqlStore) Replace(data types.DataType) (types.DataType, error) {
+    metaData, exists := types.MetaDataMap[data.TypeString()]
+    if !exists {
+        return nil, errors.New("No metadata found for specified dataType")
+    }
+    query, values, versionChecked, err := replaceSql(data, metaData.TableName(), func(i int) string { return fmt.Sprintf("$%d", i) })
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.conn.Query(context.Background(), query, values...)
+    if err != nil {
+        return nil, err
+    }
+    collector, exists := collectors[metaData.TableName()]
+    if !exists {
+        log.Println("No collector function for specified table name:", metaData.TableName())
+        return nil, errors.New("No collector function for specified data type")
+    }
+    replaced, err := pgx.CollectOneRow(rows, collector)
+    if errors.Is(err, pgx.ErrNoRows) {
+        if versionChecked {
+            return nil, VersionConflict{}
+        }
+        return nil, NoRows{}
+    }
+    return replaced, err
+}
+
+func (s *PsqlStore) Delete(metaData types.MetaData, id int64, owner_id int64, version int64) (types.DataType, error) {
     tableName := metaData.TableName()
     dataType := metaData.GetType()
 
-    col, err := getOwnerIdCol(dataType)
+    col, err := getWriterIdCol(dataType)
     if err != nil {
-        col, err = getAuthorIdCol(dataType)
-        if err != nil {
-            return nil, err
-        }
+        return nil, err
     }
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        return nil, err
+    }
+    returning := strings.Join(fields, ",")
 
-    query := fmt.Sprintf("delete from %s where id=$1 and %s=$2 returning *", tableName, col)
-    rows, err := s.conn.Query(context.Background(), query, id, owner_id)
+    query := fmt.Sprintf("delete from %s where id=$1 and %s=$2", tableName, col)
+    args := []any{id, owner_id}
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        query = fmt.Sprintf("update %s set %s=$3 where id=$1 and %s=$2 and %s=0", tableName, deletedAtCol, col, deletedAtCol)
+        args = append(args, time.Now().Unix())
+    }
+    versionChecked := false
+    if versionCol, err := getVersionCol(dataType); err == nil && version != 0 {
+        args = append(args, version)
+        query += fmt.Sprintf(" and %s=$%d", versionCol, len(args))
+        versionChecked = true
+    }
+    query += " returning " + returning
+    rows, err := s.conn.Query(context.Background(), query, args...)
     if err != nil {
         return nil, err
     }
@@ -262,6 +432,529 @@ func (s *PsqlStore) Delete(metaData types.MetaData, id int64, owner_id int64) (t
         log.Println("No collector function for specified table name:", metaData.TableName())
         return nil, errors.New("No collector function for specified data type")
     }
+    deleted, err := pgx.CollectOneRow(rows, collector)
+    if errors.Is(err, pgx.ErrNoRows) && versionChecked {
+        return nil, VersionConflict{}
+    }
+    return deleted, err
+}
+
+func (s *PsqlStore) GetDeleted(metaData types.MetaData, ownerId int64) ([]types.DataType, error) {
+    dataType := metaData.GetType()
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    col, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+
+    query := fmt.Sprintf("select %s from %s where %s=$1 and %s!=0 order by %s desc", strings.Join(fields, ","), metaData.TableName(), col, deletedAtCol, deletedAtCol)
+    rows, err := s.conn.Query(context.Background(), query, ownerId)
+    if err != nil {
+        return nil, err
+    }
+    collector, exists := collectors[metaData.TableName()]
+    if !exists {
+        return nil, errors.New("No collector function for specified data type")
+    }
+    return pgx.CollectRows(rows, collector)
+}
+
+func (s *PsqlStore) Restore(metaData types.MetaData, id int64, ownerId int64) (types.DataType, error) {
+    dataType := metaData.GetType()
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    col, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        return nil, err
+    }
+
+    // restored on its own, so no longer brought back or purged with an account deletion
+    query := fmt.Sprintf("update %s set %s=0, %s=0 where id=$1 and %s=$2 and %s!=0 returning %s",
+        metaData.TableName(), deletedAtCol, accountDeletionIdCol, col, deletedAtCol, strings.Join(fields, ","))
+    rows, err := s.conn.Query(context.Background(), query, id, ownerId)
+    if err != nil {
+        return nil, err
+    }
+    collector, exists := collectors[metaData.TableName()]
+    if !exists {
+        return nil, errors.New("No collector function for specified data type")
+    }
+    return pgx.CollectOneRow(rows, collector)
+}
+
+func (s *PsqlStore) Purge(metaData types.MetaData, id int64, ownerId int64) (types.DataType, error) {
+    dataType := metaData.GetType()
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    col, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        return nil, err
+    }
+
+    query := fmt.Sprintf("delete from %s where id=$1 and %s=$2 and %s!=0 returning %s", metaData.TableName(), col, deletedAtCol, strings.Join(fields, ","))
+    rows, err := s.conn.Query(context.Background(), query, id, ownerId)
+    if err != nil {
+        return nil, err
+    }
+    collector, exists := collectors[metaData.TableName()]
+    if !exists {
+        return nil, errors.New("No collector function for specified data type")
+    }
     return pgx.CollectOneRow(rows, collector)
 }
 
+func (s *PsqlStore) PurgeExpired(metaData types.MetaData, deletedBefore time.Time) (int64, error) {
+    deletedAtCol, err := getDeletedAtCol(metaData.GetType())
+    if err != nil {
+        return 0, err
+    }
+
+    query := fmt.Sprintf("delete from %s where %s!=0 and %s<$1", metaData.TableName(), deletedAtCol, deletedAtCol)
+    tag, err := s.conn.Exec(context.Background(), query, deletedBefore.Unix())
+    if err != nil {
+        return 0, err
+    }
+    return tag.RowsAffected(), nil
+}
+
+func (s *PsqlStore) Upsert(data types.DataType, keyCol string) (types.DataType, bool, error) {
+    metaData, exists := types.MetaDataMap[data.TypeString()]
+    if !exists {
+        return nil, false, errors.New("No metadata found for specified dataType")
+    }
+    tableName := metaData.TableName()
+
+    query, values, err := upsertSql(data, tableName, keyCol, func(i int) string { return fmt.Sprintf("$%d", i) })
+    if err != nil {
+        return nil, false, err
+    }
+    keyVal, err := getFromGlonkTag(data, keyCol)
+    if err != nil {
+        return nil, false, err
+    }
+    collector, exists := collectors[metaData.TableName()]
+    if !exists {
+        return nil, false, errors.New("No collector function for specified data type")
+    }
+
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return nil, false, err
+    }
+    defer tx.Rollback(ctx)
+
+    writerIdCol, err := getWriterIdCol(metaData.GetType())
+    if err != nil {
+        return nil, false, err
+    }
+    // who the stored record belongs to, so a version conflict is only reported to its writer
+    var storedWriterId int64
+    found := true
+    err = tx.QueryRow(ctx, fmt.Sprintf("select %s from %s where %s=$1", writerIdCol, tableName, keyCol), keyVal).Scan(&storedWriterId)
+    if errors.Is(err, pgx.ErrNoRows) {
+        found = false
+    } else if err != nil {
+        return nil, false, err
+    }
+    if keyCol == glonkIdTag && !found {
+        var allocated int64
+        err = tx.QueryRow(ctx, fmt.Sprintf("select coalesce(pg_sequence_last_value(pg_get_serial_sequence('%s', 'id')), 0)", tableName)).Scan(&allocated)
+        if err != nil {
+            return nil, false, err
+        }
+        if GetId(data) > allocated {
+            return nil, false, UnallocatedId{}
+        }
+    }
+    rows, err := tx.Query(ctx, query, values...)
+    if err != nil {
+        return nil, false, err
+    }
+    upserted, err := pgx.CollectOneRow(rows, collector)
+    if errors.Is(err, pgx.ErrNoRows) {
+        if upsertConflict(data, found, storedWriterId) {
+            return nil, false, VersionConflict{}
+        }
+        return nil, false, NoRows{}
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    if err := tx.Commit(ctx); err != nil {
+        return nil, false, err
+    }
+    return upserted, !found, nil
+}
+
+func (s *PsqlStore) Search(metaData types.MetaData, q string, ownerId int64, limit int) ([]SearchResult, error) {
+    dataType := metaData.GetType()
+    searchable := getSearchableCols(dataType)
+    if len(searchable) == 0 {
+        return nil, errors.New(dataType.Name() + " has no searchable fields")
+    }
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+
+    selected := make([]string, 0)
+    for _, field := range fields {
+        selected = append(selected, "t." + field)
+    }
+    selected = append(selected, fmt.Sprintf("ts_rank(t.%s, query)::float8 as rank", searchVectorCol))
+    for _, col := range searchable {
+        selected = append(selected, fmt.Sprintf("ts_headline('english', t.%s, query, 'StartSel=%s, StopSel=%s')", col, HighlightStart, HighlightEnd))
+    }
+    clauses := []string{fmt.Sprintf("t.%s @@ query", searchVectorCol)}
+    args := []any{q, limit}
+    ownerIdCol, err := getOwnerIdCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = $3", ownerIdCol))
+        args = append(args, ownerId)
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = 0", deletedAtCol))
+    }
+
+    query := fmt.Sprintf("select %s from %s t, websearch_to_tsquery('english', $1) query where %s order by rank desc limit $2",
+        strings.Join(selected, ","), metaData.TableName(), strings.Join(clauses, " and "))
+    rows, err := s.conn.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    results := make([]SearchResult, 0)
+    for rows.Next() {
+        row, dest := newSearchRow(dataType, fields, searchable)
+        if err := rows.Scan(dest...); err != nil {
+            return nil, err
+        }
+        result, err := row.result(searchable)
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, result)
+    }
+    return results, rows.Err()
+}
+
+func (s *PsqlStore) Aggregate(metaData types.MetaData, queries []types.Query, aggregates []Aggregate, groupBy []string, ownerId int64) ([]map[string]any, error) {
+    i := 1
+    query, args, err := aggregateSql(metaData, queries, aggregates, groupBy, ownerId, func(any) string {
+        ordinal := fmt.Sprintf("$%d", i)
+        i += 1
+        return ordinal
+    })
+    if err != nil {
+        return nil, err
+    }
+    rows, err := s.conn.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    results := make([]map[string]any, 0)
+    for rows.Next() {
+        row, dest := newAggregateRow(metaData.GetType(), aggregates, groupBy)
+        if err := rows.Scan(dest...); err != nil {
+            return nil, err
+        }
+        results = append(results, row.values(aggregates, groupBy))
+    }
+    return results, rows.Err()
+}
+
+func (s *PsqlStore) DeleteAccount(userId int64) (int64, error) {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback(ctx)
+
+    requestedAt := time.Now().Unix()
+    var deletionId int64
+    query := fmt.Sprintf("insert into %s (user_id, requested_at) values ($1, $2) returning id", accountDeletionsTable)
+    if err := tx.QueryRow(ctx, query, userId, requestedAt).Scan(&deletionId); err != nil {
+        return 0, err
+    }
+    var removed int64
+    for _, table := range accountTables() {
+        query := fmt.Sprintf("delete from %s where %s=$1", table.name, table.writerCol)
+        args := []any{userId}
+        if table.deletedAtCol != "" {
+            query = fmt.Sprintf("update %s set %s=$2, %s=$3 where %s=$1 and %s=0",
+                table.name, table.deletedAtCol, accountDeletionIdCol, table.writerCol, table.deletedAtCol)
+            args = append(args, requestedAt, deletionId)
+        }
+        tag, err := tx.Exec(ctx, query, args...)
+        if err != nil {
+            return 0, err
+        }
+        removed += tag.RowsAffected()
+    }
+    query = fmt.Sprintf("update %s set records=$2 where id=$1", accountDeletionsTable)
+    if _, err := tx.Exec(ctx, query, deletionId, removed); err != nil {
+        return 0, err
+    }
+    return removed, tx.Commit(ctx)
+}
+
+func (s *PsqlStore) RestoreAccount(userId int64) (int64, error) {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback(ctx)
+
+    pending := "user_id=$1 and restored_at is null and purged_at is null"
+    var deletionId int64
+    err = tx.QueryRow(ctx, fmt.Sprintf("select id from %s where %s", accountDeletionsTable, pending), userId).Scan(&deletionId)
+    if errors.Is(err, pgx.ErrNoRows) {
+        return 0, NoRows{}
+    }
+    if err != nil {
+        return 0, err
+    }
+    var restored int64
+    for _, table := range accountTables() {
+        if table.deletedAtCol == "" {
+            continue
+        }
+        query := fmt.Sprintf("update %s set %s=0, %s=0 where %s=$1 and %s=$2",
+            table.name, table.deletedAtCol, accountDeletionIdCol, table.writerCol, accountDeletionIdCol)
+        tag, err := tx.Exec(ctx, query, userId, deletionId)
+        if err != nil {
+            return 0, err
+        }
+        restored += tag.RowsAffected()
+    }
+    query := fmt.Sprintf("update %s set restored_at=$2 where %s", accountDeletionsTable, pending)
+    if _, err := tx.Exec(ctx, query, userId, time.Now().Unix()); err != nil {
+        return 0, err
+    }
+    return restored, tx.Commit(ctx)
+}
+
+func (s *PsqlStore) PurgeAccounts(requestedBefore time.Time) (int64, error) {
+    query := fmt.Sprintf("select user_id from %s where restored_at is null and purged_at is null and requested_at < $1", accountDeletionsTable)
+    rows, err := s.conn.Query(context.Background(), query, requestedBefore.Unix())
+    if err != nil {
+        return 0, err
+    }
+    userIds, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+    if err != nil {
+        return 0, err
+    }
+
+    var purged int64
+    for _, userId := range userIds {
+        if err := s.purgeAccount(userId); err != nil {
+            return purged, err
+        }
+        purged += 1
+    }
+    return purged, nil
+}
+
+// deletes the user, everything they own or authored, and marks the deletion done
+func (s *PsqlStore) purgeAccount(userId int64) error {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    for _, table := range accountTables() {
+        if _, err := tx.Exec(ctx, fmt.Sprintf("delete from %s where %s=$1", table.name, table.writerCol), userId); err != nil {
+            return err
+        }
+    }
+    if _, err := tx.Exec(ctx, fmt.Sprintf("delete from %s where id=$1", types.UserMeta.TableName()), userId); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(ctx, fmt.Sprintf("delete from %s where user_id=$1", quotaOverridesTable), userId); err != nil {
+        return err
+    }
+    query := fmt.Sprintf("update %s set purged_at=$2 where user_id=$1 and restored_at is null and purged_at is null", accountDeletionsTable)
+    if _, err := tx.Exec(ctx, query, userId, time.Now().Unix()); err != nil {
+        return err
+    }
+    return tx.Commit(ctx)
+}
+
+func (s *PsqlStore) AppendAudit(entry AuditEntry) error {
+    query, values, err := appendAuditSql(entry, func(i int) string { return fmt.Sprintf("$%d", i) })
+    if err != nil {
+        return err
+    }
+    _, err = s.conn.Exec(context.Background(), query, values...)
+    return err
+}
+
+func (s *PsqlStore) GetAudit(filter AuditFilter) ([]AuditEntry, error) {
+    i := 1
+    query, args := getAuditSql(filter, func(any) string {
+        ordinal := fmt.Sprintf("$%d", i)
+        i += 1
+        return ordinal
+    })
+    rows, err := s.conn.Query(context.Background(), query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    entries := make([]AuditEntry, 0)
+    for rows.Next() {
+        var row auditRow
+        if err := rows.Scan(row.dests()...); err != nil {
+            return nil, err
+        }
+        entry, err := row.decode()
+        if err != nil {
+            return nil, err
+        }
+        entries = append(entries, entry)
+    }
+    return entries, rows.Err()
+}
+
+// the bucket row is locked for the transaction so concurrent servers take tokens in turn
+func (s *PsqlStore) TakeToken(key string, limit RateLimit) (bool, time.Duration, error) {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return false, 0, err
+    }
+    defer tx.Rollback(ctx)
+
+    now := time.Now()
+    bucket := NewBucket(limit, now)
+    insert := fmt.Sprintf("insert into %s (key, tokens, updated_at) values ($1, $2, $3) on conflict (key) do nothing", rateLimitsTable)
+    if _, err := tx.Exec(ctx, insert, key, bucket.Tokens, now.UnixMicro()); err != nil {
+        return false, 0, err
+    }
+    var updated int64
+    err = tx.QueryRow(ctx, fmt.Sprintf("select tokens, updated_at from %s where key=$1 for update", rateLimitsTable), key).Scan(&bucket.Tokens, &updated)
+    if err != nil {
+        return false, 0, err
+    }
+    bucket.Updated = time.UnixMicro(updated)
+    bucket, allowed, wait := bucket.Take(limit, now)
+    update := fmt.Sprintf("update %s set tokens=$2, updated_at=$3 where key=$1", rateLimitsTable)
+    if _, err := tx.Exec(ctx, update, key, bucket.Tokens, bucket.Updated.UnixMicro()); err != nil {
+        return false, 0, err
+    }
+    return allowed, wait, tx.Commit(ctx)
+}
+
+func (s *PsqlStore) PruneRateLimits(idleSince time.Time) (int64, error) {
+    tag, err := s.conn.Exec(context.Background(), fmt.Sprintf("delete from %s where updated_at < $1", rateLimitsTable), idleSince.UnixMicro())
+    if err != nil {
+        return 0, err
+    }
+    return tag.RowsAffected(), nil
+}
+
+func (s *PsqlStore) Usage(metaData types.MetaData, ownerId int64) (Usage, error) {
+    var usage Usage
+    query, args, err := usageSql(metaData, ownerId, func(col string) string { return fmt.Sprintf("octet_length(%s::text)", col) }, "$1")
+    if err != nil {
+        return usage, err
+    }
+    err = s.conn.QueryRow(context.Background(), query, args...).Scan(&usage.Records, &usage.Bytes)
+    return usage, err
+}
+
+func (s *PsqlStore) GetQuotaOverrides(userId int64) (map[string]Quota, error) {
+    rows, err := s.conn.Query(context.Background(), fmt.Sprintf("select data_type, max_records, max_bytes from %s where user_id=$1", quotaOverridesTable), userId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    overrides := make(map[string]Quota)
+    for rows.Next() {
+        var dataType string
+        var quota Quota
+        if err := rows.Scan(&dataType, &quota.MaxRecords, &quota.MaxBytes); err != nil {
+            return nil, err
+        }
+        overrides[dataType] = quota
+    }
+    return overrides, rows.Err()
+}
+
+func (s *PsqlStore) SetQuotaOverrides(userId int64, overrides map[string]Quota) error {
+    ctx := context.Background()
+    tx, err := s.conn.Begin(ctx)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback(ctx)
+
+    if _, err := tx.Exec(ctx, fmt.Sprintf("delete from %s where user_id=$1", quotaOverridesTable), userId); err != nil {
+        return err
+    }
+    query := fmt.Sprintf("insert into %s (user_id, data_type, max_records, max_bytes) values ($1, $2, $3, $4)", quotaOverridesTable)
+    for dataType, quota := range overrides {
+        if _, err := tx.Exec(ctx, query, userId, dataType, quota.MaxRecords, quota.MaxBytes); err != nil {
+            return err
+        }
+    }
+    return tx.Commit(ctx)
+}
+
+// the upsert only takes the lock over when the previous holder's lease is up, in one statement
+func (s *PsqlStore) LockQuota(dataType string, ownerId int64) (func() error, error) {
+    ctx := context.Background()
+    acquire := func(key string, holder string) (bool, error) {
+        now := time.Now()
+        query := fmt.Sprintf("insert into %s (key, holder, expires_at) values ($1, $2, $3) on conflict (key) do update set holder=excluded.holder, expires_at=excluded.expires_at where %s.expires_at <= $4", quotaLocksTable, quotaLocksTable)
+        tag, err := s.conn.Exec(ctx, query, key, holder, now.Add(quotaLockLease).UnixMicro(), now.UnixMicro())
+        if err != nil {
+            return false, err
+        }
+        return tag.RowsAffected() > 0, nil
+    }
+    release := func(key string, holder string) error {
+        _, err := s.conn.Exec(ctx, fmt.Sprintf("delete from %s where key=$1 and holder=$2", quotaLocksTable), key, holder)
+        return err
+    }
+    return lockQuota(dataType, ownerId, acquire, release)
+}
+
+
+func (s *PsqlStore) Close() error {
+    // waits for acquired connections to be released
+    s.conn.Close()
+    return nil
+}
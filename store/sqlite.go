@@ -5,6 +5,11 @@ import (
 	"fmt"
 	"errors"
 	"strings"
+	"time"
+	"iter"
+	"context"
+	"regexp"
+	"slices"
 	"database/sql"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -20,6 +25,19 @@ func NewSqliteStore() (*SqliteStore, error) {
     conn, err := sql.Open("sqlite3", "./test.db")
     if err != nil {
         return nil, err
+    }
+    // fts5 indexes' triggers fire on every write to their tables and fail without the module
+    var hasFts5 bool
+    if err := conn.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&hasFts5); err != nil {
+        return nil, err
+    }
+    var ftsTables int
+    err = conn.QueryRow("SELECT count(*) FROM sqlite_master where type = 'table' and sql like 'CREATE VIRTUAL TABLE % USING fts5%'").Scan(&ftsTables)
+    if err != nil {
+        return nil, err
+    }
+    if ftsTables > 0 && !hasFts5 {
+        return nil, errors.New("The database has fts5 indexes but sqlite was built without fts5, build with -tags sqlite_fts5 or bootstrap without it")
     }
 	return &SqliteStore{ conn: conn }, nil
 }
@@ -41,6 +59,10 @@ func (s *SqliteStore) Get(metaData types.MetaData, id int64, owner_id int64) (ty
 		query += fmt.Sprintf(" and %s = (?)", ownerIdCol)
 		vals = append(vals, owner_id)
     }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+		query += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
 
 	statement, err := s.conn.Prepare(query)
 
@@ -71,6 +93,10 @@ func (s *SqliteStore) GetByGuid(metaData types.MetaData, guid string) (types.Dat
         return nil, err
     }
 	query := fmt.Sprintf("SELECT %s FROM %s where guid = (?)", strings.Join(fields, ","), tableName)
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+		query += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
 	statement, err := s.conn.Prepare(query)
 	rows, err := statement.Query(guid)
 	if err != nil {
@@ -92,50 +118,36 @@ func (s *SqliteStore) GetByGuid(metaData types.MetaData, guid string) (types.Dat
 }
 
 func (s *SqliteStore) GetByQueries(metaData types.MetaData, queries []types.Query, ownerId int64) ([]types.DataType, error) {
-    dataType := metaData.GetType()
-    tableName := metaData.TableName()
+    return collect(s.StreamByQueries(metaData, queries, ownerId))
+}
 
-    fields, err := intoSqlFields(dataType)
-    if err != nil {
-        log.Println("Could not retreive sql fields for ", dataType)
-        return nil, err
-    }
-    clauses := make([]string, 0)
-    finalArgs := make([]any, 0)
-    for _, query := range queries {
-        clause, args := query.Sql()
-        for k, v := range args {
-            named := fmt.Sprintf("@%s", k)
-            clause = strings.Replace(clause, named, "?", -1)
-            finalArgs = append(finalArgs, v)
-        }
-        clauses = append(clauses, "(" + clause + ")")
-    }
+func (s *SqliteStore) StreamByQueries(metaData types.MetaData, queries []types.Query, ownerId int64) iter.Seq2[types.DataType, error] {
+    return s.stream(metaData, func(placeholder func(any) string) (string, []any, error) {
+        return byQueriesSql(metaData, queries, ownerId, placeholder)
+    })
+}
 
-    ownerIdCol, err := getOwnerIdCol(metaData.GetType())
-    if err == nil {
-        ownerIdClause := fmt.Sprintf("%s = ?", ownerIdCol)
-        clauses = append(clauses, ownerIdClause)
-        finalArgs = append(finalArgs, ownerId)
-    }
+func (s *SqliteStore) GetReferenced(metaData types.MetaData, queries []types.Query) ([]types.DataType, error) {
+    return collect(s.stream(metaData, func(placeholder func(any) string) (string, []any, error) {
+        return referencedSql(metaData, queries, placeholder)
+    }))
+}
 
-    query := fmt.Sprintf("select %s from %s", strings.Join(fields, ","), tableName)
-    if len(clauses) > 0 {
-        query += " where " + strings.Join(clauses, " and ")
+func (s *SqliteStore) stream(metaData types.MetaData, build func(func(any) string) (string, []any, error)) iter.Seq2[types.DataType, error] {
+    return func(yield func(types.DataType, error) bool) {
+        query, args, err := build(func(any) string { return "?" })
+        if err != nil {
+            yield(nil, err)
+            return
+        }
+		rows, err := s.conn.Query(query, args...)
+		if err != nil {
+			log.Println(err.Error())
+			yield(nil, err)
+			return
+		}
+		scanRows(rows, metaData.GetType())(yield)
     }
-	statement, err := s.conn.Prepare(query)
-
-	rows, err := statement.Query(finalArgs...)
-	if err != nil {
-		log.Println(err.Error())
-		return nil, err
-	}
-
-	data, err := scanType(rows, dataType)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
 }
 
 func (s *SqliteStore) Create(data types.DataType) (types.DataType, error) {
@@ -146,17 +158,15 @@ func (s *SqliteStore) Create(data types.DataType) (types.DataType, error) {
     dataType := metaData.GetType()
     tableName := metaData.TableName()
 
-    rowVals, err := intoRow(data)
+    fields, values, err := intoInsert(data)
     if err != nil {
         return nil, err
     }
-    values := rowVals[1:]
     allFields, err := intoSqlFields(dataType)
     if err != nil {
         log.Println("Could not retreive sql fields for ", dataType)
         return nil, err
     }
-    fields := allFields[1:]
     placeholders := make([]string, 0)
     for _, _ = range fields {
         placeholders = append(placeholders, "?")
@@ -185,6 +195,74 @@ func (s *SqliteStore) Create(data types.DataType) (types.DataType, error) {
 	return created[0], nil
 }
 
+func (s *SqliteStore) CreateMany(data []types.DataType) ([]types.DataType, error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := s.createInTx(tx, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *SqliteStore) CreateBatches(batches [][]types.DataType, prepare func(int, [][]types.DataType) error) ([][]types.DataType, error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created := make([][]types.DataType, 0, len(batches))
+	for i, batch := range batches {
+		if err := prepare(i, created); err != nil {
+			return nil, err
+		}
+		records, err := s.createInTx(tx, batch)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, records)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *SqliteStore) createInTx(tx *sql.Tx, data []types.DataType) ([]types.DataType, error) {
+	created := make([]types.DataType, 0, len(data))
+	for _, record := range data {
+		metaData, exists := types.MetaDataMap[record.TypeString()]
+		if !exists {
+			return nil, errors.New("No metadata found for specified dataType")
+		}
+		query, values, err := insertSql(record, metaData.TableName(), func(int) string { return "?" })
+		if err != nil {
+			return nil, err
+		}
+		rows, err := tx.Query(query, values...)
+		if err != nil {
+			return nil, err
+		}
+		inserted, err := scanType(rows, metaData.GetType())
+		if err != nil {
+			return nil, err
+		}
+		if len(inserted) != 1 {
+			return nil, errors.New(fmt.Sprintf("Multiple (%d) entries created for %v", len(inserted), inserted))
+		}
+		created = append(created, inserted[0])
+	}
+	return created, nil
+}
+
 func (s *SqliteStore) Update(data types.DataType) (types.DataType, error) {
     metaData, exists := types.MetaDataMap[data.TypeString()]
     if !exists {
@@ -213,21 +291,46 @@ func (s *SqliteStore) Update(data types.DataType) (types.DataType, error) {
             i += 1
         }
     }
+    updatedAtCol, err := getUpdatedAtCol(dataType)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = $%d", updatedAtCol, i))
+        values = append(values, now())
+        i += 1
+    }
     values = append(values, GetId(data))
-    ownerIdValue, err := GetOwnerId(data)
-    authorOwnerField := "owner_id"
+    ownerIdValue, err := GetWriterId(data)
     if err != nil {
-        ownerIdValue, err = GetAuthorId(data)
-        if err != nil {
-            return nil, err
-        }
-        authorOwnerField = "author_id"
+        return nil, err
+    }
+    authorOwnerField, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
     }
     values = append(values, ownerIdValue)
+
+    whereString := fmt.Sprintf("id = $%d and %s = $%d", i, authorOwnerField, i + 1)
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        whereString += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
+    versionChecked := false
+    versionCol, err := getVersionCol(dataType)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = %s + 1", versionCol, versionCol))
+        version, err := GetVersion(data)
+        if err == nil && version != 0 {
+            whereString += fmt.Sprintf(" and %s = $%d", versionCol, i + 2)
+            values = append(values, version)
+            versionChecked = true
+        }
+    }
     fieldSetString := strings.Join(setStrings, ", ")
 
-    query := fmt.Sprintf("update %s set %s where id = $%d and %s = $%d returning %s", tableName, fieldSetString, i, authorOwnerField, i + 1, strings.Join(fields, ","))
+    query := fmt.Sprintf("update %s set %s where %s returning %s", tableName, fieldSetString, whereString, strings.Join(fields, ","))
 	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := statement.Query(values...)
 	if err != nil {
 		log.Println(err.Error())
@@ -238,13 +341,16 @@ func (s *SqliteStore) Update(data types.DataType) (types.DataType, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(updated) == 0 && versionChecked {
+		return nil, VersionConflict{}
+	}
 	if len(updated) != 1 {
 		return nil, errors.New(fmt.Sprintf("Multiple (%d) entries updated for id: %d, owner_id: %d", len(updated), GetId(data), ownerIdValue))
 	}
 	return updated[0], nil
 }
 
-func (s *SqliteStore) Delete(metaData types.MetaData, id int64, owner_id int64) (types.DataType, error) {
+func (s *SqliteStore) Delete(metaData types.MetaData, id int64, owner_id int64, version int64) (types.DataType, error) {
 	// TODO: this should probably query first and then delete
 	// if multiple entries are found, we should report the error rather than
 	// reporting multiple entries were deleted
@@ -255,9 +361,29 @@ func (s *SqliteStore) Delete(metaData types.MetaData, id int64, owner_id int64)
         log.Println("Could not retreive sql fields for ", dataType)
         return nil, err
     }
-	query := fmt.Sprintf("DELETE FROM %s where id = (?) and owner_id = (?) returning %s", tableName, strings.Join(fields, ","))
+    writerIdCol, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+	query := fmt.Sprintf("DELETE FROM %s where id = (?) and %s = (?)", tableName, writerIdCol)
+	vals := []any{id, owner_id}
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+		query = fmt.Sprintf("UPDATE %s set %s = (?) where id = (?) and %s = (?) and %s = 0", tableName, deletedAtCol, writerIdCol, deletedAtCol)
+		vals = []any{time.Now().Unix(), id, owner_id}
+    }
+    versionChecked := false
+    if versionCol, err := getVersionCol(dataType); err == nil && version != 0 {
+        query += fmt.Sprintf(" and %s = (?)", versionCol)
+        vals = append(vals, version)
+        versionChecked = true
+    }
+	query += " returning " + strings.Join(fields, ",")
 	statement, err := s.conn.Prepare(query)
-	rows, err := statement.Query(id, owner_id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(vals...)
 	if err != nil {
 		log.Println(err.Error())
 		return nil, err
@@ -267,8 +393,708 @@ func (s *SqliteStore) Delete(metaData types.MetaData, id int64, owner_id int64)
 	if err != nil {
 		return nil, err
 	}
+	if len(data) == 0 && versionChecked {
+		return nil, VersionConflict{}
+	}
 	if len(data) != 1 {
 		return nil, errors.New(fmt.Sprintf("Multiple (%d) entries deleted for id: %d, owner_id: %d", len(data), id, owner_id))
 	}
 	return data[0], nil
 }
+
+func (s *SqliteStore) GetDeleted(metaData types.MetaData, owner_id int64) ([]types.DataType, error) {
+	dataType := metaData.GetType()
+	tableName := metaData.TableName()
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    writerIdCol, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+	query := fmt.Sprintf("SELECT %s FROM %s where %s = (?) and %s != 0 order by %s desc", strings.Join(fields, ","), tableName, writerIdCol, deletedAtCol, deletedAtCol)
+	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(owner_id)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	return scanType(rows, dataType)
+}
+
+func (s *SqliteStore) Restore(metaData types.MetaData, id int64, owner_id int64) (types.DataType, error) {
+	dataType := metaData.GetType()
+	tableName := metaData.TableName()
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    writerIdCol, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+	// restored on its own, so no longer brought back or purged with an account deletion
+	query := fmt.Sprintf("UPDATE %s set %s = 0, %s = 0 where id = (?) and %s = (?) and %s != 0 returning %s",
+		tableName, deletedAtCol, accountDeletionIdCol, writerIdCol, deletedAtCol, strings.Join(fields, ","))
+	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(id, owner_id)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+
+	data, err := scanType(rows, dataType)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, NoRows{}
+	}
+	return data[0], nil
+}
+
+func (s *SqliteStore) Purge(metaData types.MetaData, id int64, owner_id int64) (types.DataType, error) {
+	dataType := metaData.GetType()
+	tableName := metaData.TableName()
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+    writerIdCol, err := getWriterIdCol(dataType)
+    if err != nil {
+        return nil, err
+    }
+	query := fmt.Sprintf("DELETE FROM %s where id = (?) and %s = (?) and %s != 0 returning %s", tableName, writerIdCol, deletedAtCol, strings.Join(fields, ","))
+	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(id, owner_id)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+
+	data, err := scanType(rows, dataType)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, NoRows{}
+	}
+	return data[0], nil
+}
+
+func (s *SqliteStore) PurgeExpired(metaData types.MetaData, deletedBefore time.Time) (int64, error) {
+    deletedAtCol, err := getDeletedAtCol(metaData.GetType())
+    if err != nil {
+        return 0, err
+    }
+	query := fmt.Sprintf("DELETE FROM %s where %s != 0 and %s < (?)", metaData.TableName(), deletedAtCol, deletedAtCol)
+	result, err := s.conn.Exec(query, deletedBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SqliteStore) Replace(data types.DataType) (types.DataType, error) {
+    metaData, exists := types.MetaDataMap[data.TypeString()]
+    if !exists {
+        return nil, errors.New("No metadata found for specified dataType")
+    }
+    query, values, versionChecked, err := replaceSql(data, metaData.TableName(), func(int) string { return "?" })
+    if err != nil {
+        return nil, err
+    }
+	rows, err := s.conn.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	replaced, err := scanType(rows, metaData.GetType())
+	if err != nil {
+		return nil, err
+	}
+	if len(replaced) == 0 && versionChecked {
+		return nil, VersionConflict{}
+	}
+	if len(replaced) == 0 {
+		return nil, NoRows{}
+	}
+	return replaced[0], nil
+}
+
+func (s *SqliteStore) Upsert(data types.DataType, keyCol string) (types.DataType, bool, error) {
+    metaData, exists := types.MetaDataMap[data.TypeString()]
+    if !exists {
+        return nil, false, errors.New("No metadata found for specified dataType")
+    }
+    dataType := metaData.GetType()
+    tableName := metaData.TableName()
+
+    query, values, err := upsertSql(data, tableName, keyCol, func(int) string { return "?" })
+    if err != nil {
+        return nil, false, err
+    }
+    keyVal, err := getFromGlonkTag(data, keyCol)
+    if err != nil {
+        return nil, false, err
+    }
+
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	writerIdCol, err := getWriterIdCol(dataType)
+	if err != nil {
+		return nil, false, err
+	}
+	// who the stored record belongs to, so a version conflict is only reported to its writer
+	var storedWriterId int64
+	found := true
+	err = tx.QueryRow(fmt.Sprintf("SELECT %s FROM %s where %s = (?)", writerIdCol, tableName, keyCol), keyVal).Scan(&storedWriterId)
+	if errors.Is(err, sql.ErrNoRows) {
+		found = false
+	} else if err != nil {
+		return nil, false, err
+	}
+	if keyCol == glonkIdTag && !found {
+		var allocated int64
+		err = tx.QueryRow("SELECT coalesce((SELECT seq FROM sqlite_sequence where name = (?)), 0)", tableName).Scan(&allocated)
+		if err != nil {
+			return nil, false, err
+		}
+		if GetId(data) > allocated {
+			return nil, false, UnallocatedId{}
+		}
+	}
+	rows, err := tx.Query(query, values...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, false, err
+	}
+	upserted, err := scanType(rows, dataType)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(upserted) == 0 {
+		if upsertConflict(data, found, storedWriterId) {
+			return nil, false, VersionConflict{}
+		}
+		return nil, false, NoRows{}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return upserted[0], !found, nil
+}
+
+// whether the database has the fts5 index of a table, only bootstrapped when sqlite is built with fts5
+func (s *SqliteStore) hasFts(tableName string) (bool, error) {
+    var count int
+    err := s.conn.QueryRow("SELECT count(*) FROM sqlite_master where type = 'table' and name = (?)", ftsTable(tableName)).Scan(&count)
+    return count > 0, err
+}
+
+func (s *SqliteStore) Search(metaData types.MetaData, q string, ownerId int64, limit int) ([]SearchResult, error) {
+    dataType := metaData.GetType()
+    tableName := metaData.TableName()
+    ftsTableName := ftsTable(tableName)
+    searchable := getSearchableCols(dataType)
+    if len(searchable) == 0 {
+        return nil, errors.New(dataType.Name() + " has no searchable fields")
+    }
+    fields, err := intoSqlFields(dataType)
+    if err != nil {
+        log.Println("Could not retreive sql fields for ", dataType)
+        return nil, err
+    }
+    hasFts, err := s.hasFts(tableName)
+    if err != nil {
+        return nil, err
+    }
+    if !hasFts {
+        return s.searchLike(metaData, fields, searchable, q, ownerId, limit)
+    }
+    match := ftsQuery(q)
+    if match == "" {
+        return []SearchResult{}, nil
+    }
+
+    selected := make([]string, 0)
+    for _, field := range fields {
+        selected = append(selected, "t." + field)
+    }
+    // bm25 is lower for better matches
+    selected = append(selected, fmt.Sprintf("-bm25(%s)", ftsTableName))
+    for i := range searchable {
+        selected = append(selected, fmt.Sprintf("snippet(%s, %d, '%s', '%s', '...', 32)", ftsTableName, i, HighlightStart, HighlightEnd))
+    }
+    clauses := []string{fmt.Sprintf("%s match (?)", ftsTableName)}
+    vals := []any{match}
+    ownerIdCol, err := getOwnerIdCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = (?)", ownerIdCol))
+        vals = append(vals, ownerId)
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = 0", deletedAtCol))
+    }
+    vals = append(vals, limit)
+
+	query := fmt.Sprintf("SELECT %s FROM %s join %s t on t.id = %s.rowid where %s order by bm25(%s) limit (?)",
+		strings.Join(selected, ","), ftsTableName, tableName, ftsTableName, strings.Join(clauses, " and "), ftsTableName)
+	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(vals...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		row, dest := newSearchRow(dataType, fields, searchable)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result, err := row.result(searchable)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// search without an fts5 index: every term has to appear in one of the searchable columns,
+// matches are unranked and newest first, highlights are the whole column with the terms marked
+func (s *SqliteStore) searchLike(metaData types.MetaData, fields []string, searchable []string, q string, ownerId int64, limit int) ([]SearchResult, error) {
+    dataType := metaData.GetType()
+    terms := strings.Fields(q)
+    if len(terms) == 0 {
+        return []SearchResult{}, nil
+    }
+
+    selected := make([]string, 0)
+    for _, field := range fields {
+        selected = append(selected, "t." + field)
+    }
+    selected = append(selected, "0")
+    for _, col := range searchable {
+        selected = append(selected, "t." + col)
+    }
+    clauses := make([]string, 0)
+    vals := make([]any, 0)
+    for _, term := range terms {
+        matches := make([]string, 0)
+        for _, col := range searchable {
+            matches = append(matches, fmt.Sprintf("t.%s like (?) escape '\\'", col))
+            vals = append(vals, likePattern(term))
+        }
+        clauses = append(clauses, "(" + strings.Join(matches, " or ") + ")")
+    }
+    ownerIdCol, err := getOwnerIdCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = (?)", ownerIdCol))
+        vals = append(vals, ownerId)
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("t.%s = 0", deletedAtCol))
+    }
+    vals = append(vals, limit)
+
+	query := fmt.Sprintf("SELECT %s FROM %s t where %s order by t.id desc limit (?)",
+		strings.Join(selected, ","), metaData.TableName(), strings.Join(clauses, " and "))
+	rows, err := s.conn.Query(query, vals...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+    highlight := likeHighlighter(terms)
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		row, dest := newSearchRow(dataType, fields, searchable)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result, err := row.result(searchable)
+		if err != nil {
+			return nil, err
+		}
+		for col, text := range result.Highlights {
+			result.Highlights[col] = highlight.ReplaceAllString(text, HighlightStart + "$0" + HighlightEnd)
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// like pattern matching term anywhere, with like's wildcards in term escaped
+func likePattern(term string) string {
+    escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+    return "%" + escaped + "%"
+}
+
+// matches any of the terms, ignoring case like sqlite's like does. longer terms go first so
+// a term containing another is marked whole
+func likeHighlighter(terms []string) *regexp.Regexp {
+    terms = slices.Clone(terms)
+    slices.SortFunc(terms, func(a, b string) int { return len(b) - len(a) })
+    quoted := make([]string, 0, len(terms))
+    for _, term := range terms {
+        quoted = append(quoted, regexp.QuoteMeta(term))
+    }
+    return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+func (s *SqliteStore) Aggregate(metaData types.MetaData, queries []types.Query, aggregates []Aggregate, groupBy []string, ownerId int64) ([]map[string]any, error) {
+    query, args, err := aggregateSql(metaData, queries, aggregates, groupBy, ownerId, func(any) string { return "?" })
+    if err != nil {
+        return nil, err
+    }
+	statement, err := s.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := statement.Query(args...)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]map[string]any, 0)
+	for rows.Next() {
+		row, dest := newAggregateRow(metaData.GetType(), aggregates, groupBy)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		results = append(results, row.values(aggregates, groupBy))
+	}
+	return results, rows.Err()
+}
+
+func (s *SqliteStore) DeleteAccount(userId int64) (int64, error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	requestedAt := time.Now().Unix()
+	result, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (user_id, requested_at) VALUES (?, ?)", accountDeletionsTable), userId, requestedAt)
+	if err != nil {
+		return 0, err
+	}
+	deletionId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, table := range accountTables() {
+		query := fmt.Sprintf("DELETE FROM %s where %s = (?)", table.name, table.writerCol)
+		args := []any{userId}
+		if table.deletedAtCol != "" {
+			query = fmt.Sprintf("UPDATE %s set %s = (?), %s = (?) where %s = (?) and %s = 0",
+				table.name, table.deletedAtCol, accountDeletionIdCol, table.writerCol, table.deletedAtCol)
+			args = []any{requestedAt, deletionId, userId}
+		}
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += affected
+	}
+	query := fmt.Sprintf("UPDATE %s set records = (?) where id = (?)", accountDeletionsTable)
+	if _, err := tx.Exec(query, removed, deletionId); err != nil {
+		return 0, err
+	}
+	return removed, tx.Commit()
+}
+
+func (s *SqliteStore) RestoreAccount(userId int64) (int64, error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	pending := "user_id = (?) and restored_at is null and purged_at is null"
+	var deletionId int64
+	err = tx.QueryRow(fmt.Sprintf("SELECT id FROM %s where %s", accountDeletionsTable, pending), userId).Scan(&deletionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, NoRows{}
+	}
+	if err != nil {
+		return 0, err
+	}
+	var restored int64
+	for _, table := range accountTables() {
+		if table.deletedAtCol == "" {
+			continue
+		}
+		query := fmt.Sprintf("UPDATE %s set %s = 0, %s = 0 where %s = (?) and %s = (?)",
+			table.name, table.deletedAtCol, accountDeletionIdCol, table.writerCol, accountDeletionIdCol)
+		result, err := tx.Exec(query, userId, deletionId)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		restored += affected
+	}
+	query := fmt.Sprintf("UPDATE %s set restored_at = (?) where %s", accountDeletionsTable, pending)
+	if _, err := tx.Exec(query, time.Now().Unix(), userId); err != nil {
+		return 0, err
+	}
+	return restored, tx.Commit()
+}
+
+func (s *SqliteStore) PurgeAccounts(requestedBefore time.Time) (int64, error) {
+	query := fmt.Sprintf("SELECT user_id FROM %s where restored_at is null and purged_at is null and requested_at < (?)", accountDeletionsTable)
+	rows, err := s.conn.Query(query, requestedBefore.Unix())
+	if err != nil {
+		return 0, err
+	}
+	userIds := make([]int64, 0)
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, userId := range userIds {
+		if err := s.purgeAccount(userId); err != nil {
+			return purged, err
+		}
+		purged += 1
+	}
+	return purged, nil
+}
+
+// deletes the user, everything they own or authored, and marks the deletion done
+func (s *SqliteStore) purgeAccount(userId int64) error {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range accountTables() {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where %s = (?)", table.name, table.writerCol), userId); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where id = (?)", types.UserMeta.TableName()), userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where user_id = (?)", quotaOverridesTable), userId); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("UPDATE %s set purged_at = (?) where user_id = (?) and restored_at is null and purged_at is null", accountDeletionsTable)
+	if _, err := tx.Exec(query, time.Now().Unix(), userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqliteStore) AppendAudit(entry AuditEntry) error {
+	query, values, err := appendAuditSql(entry, func(int) string { return "?" })
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Exec(query, values...)
+	return err
+}
+
+func (s *SqliteStore) GetAudit(filter AuditFilter) ([]AuditEntry, error) {
+	query, args := getAuditSql(filter, func(any) string { return "?" })
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var row auditRow
+		if err := rows.Scan(row.dests()...); err != nil {
+			return nil, err
+		}
+		entry, err := row.decode()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// runs fn in a transaction that takes the write lock up front. a deferred transaction that
+// reads then writes fails with SQLITE_BUSY when another writer got in between, an immediate one
+// waits for the lock on the busy timeout instead
+func (s *SqliteStore) immediate(fn func(context.Context, *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := s.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+	if err := fn(ctx, conn); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return err
+}
+
+func (s *SqliteStore) TakeToken(key string, limit RateLimit) (bool, time.Duration, error) {
+	var allowed bool
+	var wait time.Duration
+	err := s.immediate(func(ctx context.Context, conn *sql.Conn) error {
+		now := time.Now()
+		bucket := NewBucket(limit, now)
+		var updated int64
+		err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT tokens, updated_at FROM %s where key = (?)", rateLimitsTable), key).Scan(&bucket.Tokens, &updated)
+		if err == nil {
+			bucket.Updated = time.UnixMicro(updated)
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		bucket, allowed, wait = bucket.Take(limit, now)
+		query := fmt.Sprintf("INSERT INTO %s (key, tokens, updated_at) VALUES (?, ?, ?) ON CONFLICT (key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at", rateLimitsTable)
+		_, err = conn.ExecContext(ctx, query, key, bucket.Tokens, bucket.Updated.UnixMicro())
+		return err
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
+
+func (s *SqliteStore) PruneRateLimits(idleSince time.Time) (int64, error) {
+	result, err := s.conn.Exec(fmt.Sprintf("DELETE FROM %s where updated_at < (?)", rateLimitsTable), idleSince.UnixMicro())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SqliteStore) Usage(metaData types.MetaData, ownerId int64) (Usage, error) {
+	var usage Usage
+	query, args, err := usageSql(metaData, ownerId, func(col string) string { return fmt.Sprintf("length(cast(%s as blob))", col) }, "?")
+	if err != nil {
+		return usage, err
+	}
+	err = s.conn.QueryRow(query, args...).Scan(&usage.Records, &usage.Bytes)
+	return usage, err
+}
+
+func (s *SqliteStore) GetQuotaOverrides(userId int64) (map[string]Quota, error) {
+	rows, err := s.conn.Query(fmt.Sprintf("SELECT data_type, max_records, max_bytes FROM %s where user_id = (?)", quotaOverridesTable), userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	overrides := make(map[string]Quota)
+	for rows.Next() {
+		var dataType string
+		var quota Quota
+		if err := rows.Scan(&dataType, &quota.MaxRecords, &quota.MaxBytes); err != nil {
+			return nil, err
+		}
+		overrides[dataType] = quota
+	}
+	return overrides, rows.Err()
+}
+
+func (s *SqliteStore) SetQuotaOverrides(userId int64, overrides map[string]Quota) error {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s where user_id = (?)", quotaOverridesTable), userId); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (user_id, data_type, max_records, max_bytes) VALUES (?, ?, ?, ?)", quotaOverridesTable)
+	for dataType, quota := range overrides {
+		if _, err := tx.Exec(query, userId, dataType, quota.MaxRecords, quota.MaxBytes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the upsert only takes the lock over when the previous holder's lease is up, in one statement
+func (s *SqliteStore) LockQuota(dataType string, ownerId int64) (func() error, error) {
+	acquire := func(key string, holder string) (bool, error) {
+		now := time.Now()
+		query := fmt.Sprintf("INSERT INTO %s (key, holder, expires_at) VALUES (?, ?, ?) ON CONFLICT (key) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at where %s.expires_at <= (?)", quotaLocksTable, quotaLocksTable)
+		result, err := s.conn.Exec(query, key, holder, now.Add(quotaLockLease).UnixMicro(), now.UnixMicro())
+		if err != nil {
+			return false, err
+		}
+		acquired, err := result.RowsAffected()
+		return acquired > 0, err
+	}
+	release := func(key string, holder string) error {
+		_, err := s.conn.Exec(fmt.Sprintf("DELETE FROM %s where key = (?) and holder = (?)", quotaLocksTable), key, holder)
+		return err
+	}
+	return lockQuota(dataType, ownerId, acquire, release)
+}
+
+
+func (s *SqliteStore) Close() error {
+	return s.conn.Close()
+}
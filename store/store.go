@@ -1,11 +1,19 @@
 package store
 
 import (
-	"log"
     "reflect"
     "errors"
     "strings"
+    "time"
+    "fmt"
+    "strconv"
+    "sort"
+    "encoding/json"
+    "iter"
+    "crypto/rand"
+    "encoding/hex"
 	"database/sql"
+	"database/sql/driver"
     "github.com/reshane/glonk/types"
 )
 
@@ -14,9 +22,63 @@ type Store interface {
     Get(types.MetaData, int64, int64) (types.DataType, error)
     GetByGuid(types.MetaData, string) (types.DataType, error)
     GetByQueries(types.MetaData, []types.Query, int64) ([]types.DataType, error)
+    // GetByQueries yielding records as they're read, so results needn't fit in memory
+    StreamByQueries(types.MetaData, []types.Query, int64) iter.Seq2[types.DataType, error]
+    // records matching the queries whoever owns them, for records others refer to. callers redact them
+    GetReferenced(types.MetaData, []types.Query) ([]types.DataType, error)
     Create(types.DataType) (types.DataType, error)
+    // creates every record in one transaction, returning them in the same order
+    CreateMany([]types.DataType) ([]types.DataType, error)
+    // creates each batch in order, all in one transaction. prepare may rewrite batch i in
+    // place before it's created, given the batches created before it
+    CreateBatches([][]types.DataType, func(int, [][]types.DataType) error) ([][]types.DataType, error)
     Update(types.DataType) (types.DataType, error)
-    Delete(types.MetaData, int64, int64) (types.DataType, error)
+    // deletes by id and owner, and by version unless it's 0. a version mismatch is a VersionConflict
+    Delete(types.MetaData, int64, int64, int64) (types.DataType, error)
+    // replaces every field of a live record, NoRows when its writer has none at the id
+    Replace(types.DataType) (types.DataType, error)
+    // insert or replace keyed by the id or a unique column, reports whether a row was created
+    Upsert(types.DataType, string) (types.DataType, bool, error)
+    // trash for types with a deleted_at column
+    GetDeleted(types.MetaData, int64) ([]types.DataType, error)
+    Restore(types.MetaData, int64, int64) (types.DataType, error)
+    Purge(types.MetaData, int64, int64) (types.DataType, error)
+    PurgeExpired(types.MetaData, time.Time) (int64, error)
+    // full text search over searchable columns, best matches first
+    Search(types.MetaData, string, int64, int) ([]SearchResult, error)
+    // aggregates over the records matching the queries, one row per group
+    Aggregate(types.MetaData, []types.Query, []Aggregate, []string, int64) ([]map[string]any, error)
+
+    // moves every record the user owns or authored to the trash and records the pending
+    // deletion in one transaction, returning the number of records removed
+    DeleteAccount(int64) (int64, error)
+    // brings back the records trashed by a pending account deletion, NoRows when there is none
+    RestoreAccount(int64) (int64, error)
+    // hard deletes accounts whose deletion was requested before the given time, with all their records
+    PurgeAccounts(time.Time) (int64, error)
+
+    // appends to the audit log, which is never updated or deleted from
+    AppendAudit(AuditEntry) error
+    // audit log entries matching the filter, newest first
+    GetAudit(AuditFilter) ([]AuditEntry, error)
+
+    // takes a token from the rate limit bucket at key, shared by every server using the store
+    TakeToken(string, RateLimit) (bool, time.Duration, error)
+    // drops rate limit buckets untouched since the given time
+    PruneRateLimits(time.Time) (int64, error)
+
+    // records and bytes the user stores of a data type, trashed records included
+    Usage(types.MetaData, int64) (Usage, error)
+    // per data type quotas set for a user in place of the defaults
+    GetQuotaOverrides(int64) (map[string]Quota, error)
+    // replaces every quota override of a user
+    SetQuotaOverrides(int64, map[string]Quota) error
+    // waits for the user's quota lock of a data type, shared by every server using the store,
+    // returning its release
+    LockQuota(string, int64) (func() error, error)
+
+    // releases the store's connections, it can't be used after
+    Close() error
 }
 
 // glonk internal reflection
@@ -82,8 +144,84 @@ var (
     glonkIdTag string = "id"
     glonkOwnerIdTag string = "owner_id"
     glonkAuthorIdTag string = "author_id"
+    glonkDeletedAtTag string = "deleted_at"
+    glonkVersionTag string = "version"
+    glonkCreatedAtTag string = "created_at"
+    glonkUpdatedAtTag string = "updated_at"
+    glonkUniqueTag string = "unique"
+    glonkBelongsToTag string = "belongs_to"
+    glonkHasManyTag string = "has_many"
+    glonkPublicTag string = "public"
+    glonkOwnerOnlyTag string = "owner_only"
+    glonkServerOnlyTag string = "server_only"
+    glonkSearchableTag string = "searchable"
+)
+
+// field visibility levels, public by default
+const (
+    Public = "public"
+    OwnerOnly = "owner_only"
+    ServerOnly = "server_only"
 )
 
+// description of a glonk tagged struct field
+type Column struct {
+    Name string
+    JsonName string
+    Field reflect.StructField
+    Visibility string
+    // maintained by the store, client values are ignored
+    Managed bool
+    // id, owner_id and author_id markers on the column
+    Roles []string
+}
+
+func GetColumns(typ reflect.Type) []Column {
+    columns := make([]Column, 0)
+    for i := 0; i < typ.NumField(); i++ {
+        field := typ.Field(i)
+        glonkName, err := getGlonkName(field)
+        if err != nil || !field.IsExported() {
+            continue
+        }
+        jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+        if jsonName == "" {
+            jsonName = field.Name
+        }
+        visibility := Public
+        if fieldHasGlonkTag(field, glonkOwnerOnlyTag) {
+            visibility = OwnerOnly
+        }
+        if fieldHasGlonkTag(field, glonkServerOnlyTag) {
+            visibility = ServerOnly
+        }
+        roles := make([]string, 0)
+        for _, role := range []string{glonkIdTag, glonkOwnerIdTag, glonkAuthorIdTag} {
+            if fieldHasGlonkTag(field, role) {
+                roles = append(roles, role)
+            }
+        }
+        columns = append(columns, Column{
+            Name: glonkName,
+            JsonName: jsonName,
+            Field: field,
+            Visibility: visibility,
+            Managed: isManaged(field),
+            Roles: roles,
+        })
+    }
+    return columns
+}
+
+// id of the user who owns or authored a record
+func GetWriterId(a any) (int64, error) {
+    ownerId, err := GetOwnerId(a)
+    if err == nil {
+        return ownerId, nil
+    }
+    return GetAuthorId(a)
+}
+
 func isId(field reflect.StructField) bool {
     return fieldHasGlonkTag(field, glonkIdTag)
 }
@@ -165,6 +303,336 @@ func getAuthorIdCol(typ reflect.Type) (string, error) {
     return "", errors.New("No glonk author_id found for type " + typ.Name())
 }
 
+func isDeletedAt(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkDeletedAtTag)
+}
+
+func getDeletedAtCol(typ reflect.Type) (string, error) {
+    for i := 0; i < typ.NumField(); i++ {
+        if isDeletedAt(typ.Field(i)) {
+            tagStr := typ.Field(i).Tag.Get(glonkTagStr)
+            tags := strings.Split(tagStr, ",")
+            return tags[0], nil
+        }
+    }
+    return "", errors.New("No glonk deleted_at found for type " + typ.Name())
+}
+
+// HasTrash reports whether deletes of this type are soft deletes
+func HasTrash(metaData types.MetaData) bool {
+    _, err := getDeletedAtCol(metaData.GetType())
+    return err == nil
+}
+
+// column holding the id of the user allowed to write a record
+func getWriterIdCol(typ reflect.Type) (string, error) {
+    col, err := getOwnerIdCol(typ)
+    if err == nil {
+        return col, nil
+    }
+    return getAuthorIdCol(typ)
+}
+
+func isVersion(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkVersionTag)
+}
+
+func getVersionCol(typ reflect.Type) (string, error) {
+    for i := 0; i < typ.NumField(); i++ {
+        if isVersion(typ.Field(i)) {
+            tagStr := typ.Field(i).Tag.Get(glonkTagStr)
+            tags := strings.Split(tagStr, ",")
+            return tags[0], nil
+        }
+    }
+    return "", errors.New("No glonk version found for type " + typ.Name())
+}
+
+func GetVersion(a any) (int64, error) {
+    versionAny, err := getFromGlonkTag(a, glonkVersionTag)
+    if err != nil {
+        return -1, err
+    }
+    version, ok := versionAny.(int64)
+    if !ok {
+        return -1, errors.New("version type must be int64 on " + reflect.TypeOf(a).Name())
+    }
+    return version, nil
+}
+
+func GetUpdatedAt(a any) (time.Time, error) {
+    updatedAny, err := getFromGlonkTag(a, glonkUpdatedAtTag)
+    if err != nil {
+        return time.Time{}, err
+    }
+    updatedAt, ok := updatedAny.(time.Time)
+    if !ok {
+        return time.Time{}, errors.New("updated_at type must be time.Time on " + reflect.TypeOf(a).Name())
+    }
+    return updatedAt, nil
+}
+
+// IsPrivate reports whether records of this type are only visible to their owner
+func IsPrivate(metaData types.MetaData) bool {
+    _, err := getOwnerIdCol(metaData.GetType())
+    return err == nil
+}
+
+// returns a copy of dt with the int64 field tagged glonkTag set
+func setGlonkInt(dt types.DataType, glonkTag string, value int64) (types.DataType, error) {
+    val := reflect.New(reflect.TypeOf(dt)).Elem()
+    val.Set(reflect.ValueOf(dt))
+    for i := 0; i < val.NumField(); i++ {
+        if fieldHasGlonkTag(val.Type().Field(i), glonkTag) {
+            val.Field(i).SetInt(value)
+            return val.Interface().(types.DataType), nil
+        }
+    }
+    return nil, errors.New("No glonk " + glonkTag + " found for type " + val.Type().Name())
+}
+
+// returns a copy of dt with its version field set
+func SetVersion(dt types.DataType, version int64) (types.DataType, error) {
+    return setGlonkInt(dt, glonkVersionTag, version)
+}
+
+// returns a copy of dt with its id field set
+func SetId(dt types.DataType, id int64) (types.DataType, error) {
+    return setGlonkInt(dt, glonkIdTag, id)
+}
+
+// returns a copy of dt with its owner_id or author_id field set
+func SetWriterId(dt types.DataType, id int64) (types.DataType, error) {
+    col, err := getWriterIdCol(reflect.TypeOf(dt))
+    if err != nil {
+        return nil, err
+    }
+    return setGlonkInt(dt, col, id)
+}
+
+// returns a copy of dt with the int64 field stored in column col set
+func SetColumnInt(dt types.DataType, col string, value int64) (types.DataType, error) {
+    return setGlonkInt(dt, col, value)
+}
+
+func isUnique(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkUniqueTag)
+}
+
+// checks that col can be used as an upsert key
+func isUpsertKey(typ reflect.Type, col string) bool {
+    if col == glonkIdTag {
+        return true
+    }
+    for i := 0; i < typ.NumField(); i++ {
+        glonkName, err := getGlonkName(typ.Field(i))
+        if err == nil && glonkName == col {
+            return isUnique(typ.Field(i))
+        }
+    }
+    return false
+}
+
+func isCreatedAt(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkCreatedAtTag)
+}
+
+func isUpdatedAt(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkUpdatedAtTag)
+}
+
+func getCreatedAtCol(typ reflect.Type) (string, error) {
+    for i := 0; i < typ.NumField(); i++ {
+        if isCreatedAt(typ.Field(i)) {
+            tagStr := typ.Field(i).Tag.Get(glonkTagStr)
+            tags := strings.Split(tagStr, ",")
+            return tags[0], nil
+        }
+    }
+    return "", errors.New("No glonk created_at found for type " + typ.Name())
+}
+
+func getUpdatedAtCol(typ reflect.Type) (string, error) {
+    for i := 0; i < typ.NumField(); i++ {
+        if isUpdatedAt(typ.Field(i)) {
+            tagStr := typ.Field(i).Tag.Get(glonkTagStr)
+            tags := strings.Split(tagStr, ",")
+            return tags[0], nil
+        }
+    }
+    return "", errors.New("No glonk updated_at found for type " + typ.Name())
+}
+
+// timestamps written by the stores, truncated to what postgres keeps
+func now() time.Time {
+    return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// value of the field stored in column col
+func GetColumnValue(a any, col string) (any, error) {
+    return getFromGlonkTag(a, col)
+}
+
+// relationship between two data types declared in glonk tags
+//  belongs_to=<dataType> on a foreign key column, named for the column without _id
+//  has_many=<dataType>.<column> on the id, named for the other type's table
+type Relation struct {
+    Name string
+    Kind string
+    Target string
+    // column holding the key on this type (the foreign key or the id)
+    LocalCol string
+    // column matched against it on the target type
+    ForeignCol string
+}
+
+func GetRelations(typ reflect.Type) ([]Relation, error) {
+    relations := make([]Relation, 0)
+    for i := 0; i < typ.NumField(); i++ {
+        glonkName, err := getGlonkName(typ.Field(i))
+        if err != nil {
+            continue
+        }
+        tags := strings.Split(typ.Field(i).Tag.Get(glonkTagStr), ",")
+        for _, tag := range tags {
+            kind, target, found := strings.Cut(tag, "=")
+            if !found {
+                continue
+            }
+            switch kind {
+            case glonkBelongsToTag:
+                relations = append(relations, Relation{
+                    Name: strings.TrimSuffix(glonkName, "_id"),
+                    Kind: kind,
+                    Target: target,
+                    LocalCol: glonkName,
+                    ForeignCol: glonkIdTag,
+                })
+            case glonkHasManyTag:
+                targetType, foreignCol, found := strings.Cut(target, ".")
+                if !found {
+                    return nil, errors.New("has_many on " + typ.Name() + " must be <dataType>.<column>")
+                }
+                targetMeta, exists := types.MetaDataMap[targetType]
+                if !exists {
+                    return nil, errors.New("has_many on " + typ.Name() + " references unknown data type " + targetType)
+                }
+                relations = append(relations, Relation{
+                    Name: targetMeta.TableName(),
+                    Kind: kind,
+                    Target: targetType,
+                    LocalCol: glonkName,
+                    ForeignCol: foreignCol,
+                })
+            }
+        }
+    }
+    return relations, nil
+}
+
+// searchable columns are full text indexed
+//  sqlite: an external content fts5 table named <table>_fts kept in sync by triggers, like when built without fts5
+//  postgres: a generated tsvector column named search_vector with a gin index
+func isSearchable(field reflect.StructField) bool {
+    return fieldHasGlonkTag(field, glonkSearchableTag)
+}
+
+func getSearchableCols(typ reflect.Type) []string {
+    cols := make([]string, 0)
+    for i := 0; i < typ.NumField(); i++ {
+        if isSearchable(typ.Field(i)) {
+            glonkName, err := getGlonkName(typ.Field(i))
+            if err == nil {
+                cols = append(cols, glonkName)
+            }
+        }
+    }
+    return cols
+}
+
+func IsSearchable(metaData types.MetaData) bool {
+    return len(getSearchableCols(metaData.GetType())) > 0
+}
+
+const (
+    searchVectorCol = "search_vector"
+    HighlightStart = "<mark>"
+    HighlightEnd = "</mark>"
+)
+
+func ftsTable(tableName string) string {
+    return tableName + "_fts"
+}
+
+// fts5 query matching every term of q, terms are quoted so operators in q are searched for literally
+func ftsQuery(q string) string {
+    terms := make([]string, 0)
+    for _, term := range strings.Fields(q) {
+        terms = append(terms, `"` + strings.ReplaceAll(term, `"`, `""`) + `"`)
+    }
+    return strings.Join(terms, " ")
+}
+
+// a full text search hit
+type SearchResult struct {
+    Data types.DataType
+    Rank float64
+    // matching fragments of each searchable column keyed by column, matches wrapped in HighlightStart and HighlightEnd
+    Highlights map[string]string
+}
+
+// scan targets for a search row: the record's fields, its rank, then a highlight per searchable column
+type searchRow struct {
+    target reflect.Value
+    rank float64
+    highlights []sql.NullString
+}
+
+func newSearchRow(typ reflect.Type, fields []string, searchable []string) (*searchRow, []any) {
+    row := &searchRow{
+        target: reflect.New(typ).Elem(),
+        highlights: make([]sql.NullString, len(searchable)),
+    }
+    dest := scanDestinations(row.target, fields)
+    dest = append(dest, &row.rank)
+    for i := range row.highlights {
+        dest = append(dest, &row.highlights[i])
+    }
+    return row, dest
+}
+
+func (row *searchRow) result(searchable []string) (SearchResult, error) {
+    data, ok := row.target.Interface().(types.DataType)
+    if !ok {
+        return SearchResult{}, errors.New(row.target.Type().Name() + " is not a DataType")
+    }
+    highlights := make(map[string]string)
+    for i, col := range searchable {
+        if row.highlights[i].Valid {
+            highlights[col] = row.highlights[i].String
+        }
+    }
+    return SearchResult{ Data: data, Rank: row.rank, Highlights: highlights }, nil
+}
+
+// managed columns are maintained by the store and never written from client data
+func isManaged(field reflect.StructField) bool {
+    return isDeletedAt(field) || isVersion(field) || isCreatedAt(field) || isUpdatedAt(field)
+}
+
+func getManagedCols(typ reflect.Type) map[string]bool {
+    cols := make(map[string]bool)
+    for i := 0; i < typ.NumField(); i++ {
+        if isManaged(typ.Field(i)) {
+            glonkName, err := getGlonkName(typ.Field(i))
+            if err == nil {
+                cols[glonkName] = true
+            }
+        }
+    }
+    return cols
+}
+
 // glonk db functions
 func intoSqlFields(typ reflect.Type) ([]string, error) {
     colNames := []string{glonkIdTag}
@@ -226,70 +694,1144 @@ func intoRow(a any) ([]any, error) {
             continue
         }
         if val.Field(i).CanInterface() {
-            row = append(row, val.Field(i).Interface())
+            sqlVal, err := intoSqlValue(val.Field(i))
+            if err != nil {
+                return nil, errors.New("Could not convert " + typ.Field(i).Name + ": " + err.Error())
+            }
+            row = append(row, sqlVal)
         }
     }
     return row, nil
 }
 
-func scanType(rows *sql.Rows, dt reflect.Type) ([]types.DataType, error) {
-	fieldVals := make([]any, 0)
-	for i := 0; i < dt.NumField(); i++ {
-		reciever := reflect.New(dt.Field(i).Type)
-		fieldVals = append(fieldVals, reciever.Elem().Interface())
-	}
+var (
+    timeType = reflect.TypeOf(time.Time{})
+    scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+    valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+)
 
-	fieldRefs := make([]any, 0)
-	for i, _ := range fieldVals {
-		fieldRefs = append(fieldRefs, &fieldVals[i])
-	}
+// structs, maps and slices (other than []byte) are stored as json text
+func isJsonField(typ reflect.Type) bool {
+    if typ.Implements(valuerType) || reflect.PointerTo(typ).Implements(scannerType) {
+        return false
+    }
+    switch typ.Kind() {
+    case reflect.Struct:
+        return typ != timeType
+    case reflect.Map:
+        return true
+    case reflect.Slice:
+        return typ.Elem().Kind() != reflect.Uint8
+    }
+    return false
+}
 
-	data := make([]types.DataType, 0)
-	for rows.Next() {
-		targetDataPtr := reflect.New(dt)
-		targetData := targetDataPtr.Elem()
-		rows.Scan(fieldRefs...)
-		for i, val := range fieldRefs {
-			elem := reflect.ValueOf(val).Elem().Interface()
-			switch t := elem.(type) {
-			case int64:
-				targetData.Field(i).Set(reflect.ValueOf(t))
-			case float64:
-				targetData.Field(i).Set(reflect.ValueOf(t))
-			case string:
-				targetData.Field(i).Set(reflect.ValueOf(t))
-			default:
-				log.Println("missing type", reflect.TypeOf(t))
-			}
-		}
-		td, ok := targetData.Interface().(types.DataType)
-		if ok {
-			data = append(data, td)
-		}
-	}
-	return data, nil
+// value handed to the driver for a struct field
+// nil pointers, maps and slices are nil so sparse updates leave them unchanged
+func intoSqlValue(field reflect.Value) (any, error) {
+    if field.Type().Implements(valuerType) {
+        return field.Interface(), nil
+    }
+    switch field.Kind() {
+    case reflect.Pointer:
+        if field.IsNil() {
+            return nil, nil
+        }
+        return intoSqlValue(field.Elem())
+    case reflect.Map, reflect.Slice:
+        if field.IsNil() {
+            return nil, nil
+        }
+    }
+    if isJsonField(field.Type()) {
+        encoded, err := json.Marshal(field.Interface())
+        if err != nil {
+            return nil, err
+        }
+        return string(encoded), nil
+    }
+    if t, ok := field.Interface().(time.Time); ok {
+        return t.UTC(), nil
+    }
+    return field.Interface(), nil
 }
 
-func sparseUpdate(dt types.DataType) (map[string]any, error) {
-    fields, err := intoSqlFields(reflect.TypeOf(dt))
-    if err != nil {
-        return nil, err
+// sql.Scanner assigning a column value to a struct field
+// NULL sets the field to its zero value
+type fieldScanner struct {
+    field reflect.Value
+}
+
+var timeLayouts = []string{
+    time.RFC3339Nano,
+    "2006-01-02 15:04:05.999999999-07:00",
+    "2006-01-02 15:04:05.999999999",
+    "2006-01-02 15:04:05",
+    "2006-01-02",
+}
+
+func (fs *fieldScanner) Scan(src any) error {
+    field := fs.field
+    if field.CanAddr() && field.Addr().Type().Implements(scannerType) {
+        return field.Addr().Interface().(sql.Scanner).Scan(src)
+    }
+    if src == nil {
+        field.Set(reflect.Zero(field.Type()))
+        return nil
+    }
+    if field.Kind() == reflect.Pointer {
+        elem := reflect.New(field.Type().Elem())
+        if err := (&fieldScanner{ field: elem.Elem() }).Scan(src); err != nil {
+            return err
+        }
+        field.Set(elem)
+        return nil
+    }
+    if isJsonField(field.Type()) {
+        var encoded []byte
+        switch v := src.(type) {
+        case []byte:
+            encoded = v
+        case string:
+            encoded = []byte(v)
+        default:
+            return fmt.Errorf("cannot scan %T into json field %s", src, field.Type())
+        }
+        target := reflect.New(field.Type())
+        if err := json.Unmarshal(encoded, target.Interface()); err != nil {
+            return err
+        }
+        field.Set(target.Elem())
+        return nil
+    }
+    if field.Type() == timeType {
+        switch v := src.(type) {
+        case time.Time:
+            field.Set(reflect.ValueOf(v.UTC()))
+            return nil
+        case string, []byte:
+            str := fmt.Sprint(v)
+            if b, ok := v.([]byte); ok {
+                str = string(b)
+            }
+            for _, layout := range timeLayouts {
+                t, err := time.Parse(layout, str)
+                if err == nil {
+                    field.Set(reflect.ValueOf(t.UTC()))
+                    return nil
+                }
+            }
+            return fmt.Errorf("cannot parse %q as time", str)
+        }
+        return fmt.Errorf("cannot scan %T into time field", src)
     }
 
-    vals, err := intoRow(dt)
-    if err != nil {
-        return nil, err
+    switch field.Kind() {
+    case reflect.Bool:
+        switch v := src.(type) {
+        case bool:
+            field.SetBool(v)
+        case int64:
+            field.SetBool(v != 0)
+        case string:
+            b, err := strconv.ParseBool(v)
+            if err != nil {
+                return err
+            }
+            field.SetBool(b)
+        case []byte:
+            b, err := strconv.ParseBool(string(v))
+            if err != nil {
+                return err
+            }
+            field.SetBool(b)
+        default:
+            return fmt.Errorf("cannot scan %T into bool field", src)
+        }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        switch v := src.(type) {
+        case int64:
+            field.SetInt(v)
+        case float64:
+            field.SetInt(int64(v))
+        case bool:
+            if v {
+                field.SetInt(1)
+            } else {
+                field.SetInt(0)
+            }
+        case string, []byte:
+            i, err := strconv.ParseInt(fmt.Sprintf("%s", v), 10, 64)
+            if err != nil {
+                return err
+            }
+            field.SetInt(i)
+        default:
+            return fmt.Errorf("cannot scan %T into int field", src)
+        }
+    case reflect.Float32, reflect.Float64:
+        switch v := src.(type) {
+        case float64:
+            field.SetFloat(v)
+        case int64:
+            field.SetFloat(float64(v))
+        case string, []byte:
+            f, err := strconv.ParseFloat(fmt.Sprintf("%s", v), 64)
+            if err != nil {
+                return err
+            }
+            field.SetFloat(f)
+        default:
+            return fmt.Errorf("cannot scan %T into float field", src)
+        }
+    case reflect.String:
+        switch v := src.(type) {
+        case string:
+            field.SetString(v)
+        case []byte:
+            field.SetString(string(v))
+        case time.Time:
+            field.SetString(v.UTC().Format(time.RFC3339Nano))
+        default:
+            field.SetString(fmt.Sprint(v))
+        }
+    case reflect.Slice:
+        // []byte, json slices were handled above
+        switch v := src.(type) {
+        case []byte:
+            field.SetBytes(append([]byte{}, v...))
+        case string:
+            field.SetBytes([]byte(v))
+        default:
+            return fmt.Errorf("cannot scan %T into []byte field", src)
+        }
+    default:
+        return fmt.Errorf("unsupported field type %s", field.Type())
     }
-    resultMap := make(map[string]any, 0)
-    for i := 0; i < len(fields); i++ {
-        if vals[i] != nil {
-            resultMap[fields[i]] = vals[i]
+    return nil
+}
+
+// struct field index for each glonk column of typ
+func glonkFieldIndexes(typ reflect.Type) map[string]int {
+    indexes := make(map[string]int)
+    for i := 0; i < typ.NumField(); i++ {
+        glonkName, err := getGlonkName(typ.Field(i))
+        if err == nil {
+            indexes[glonkName] = i
         }
     }
-    return resultMap, nil
+    return indexes
 }
 
-type NoRows struct {}
-func (NoRows) Error() string {
-	return "No rows found"
+// scan destinations for columns into the fields of target, nil for unknown columns
+func scanDestinations(target reflect.Value, columns []string) []any {
+    indexes := glonkFieldIndexes(target.Type())
+    dests := make([]any, len(columns))
+    for i, col := range columns {
+        idx, exists := indexes[col]
+        if !exists {
+            dests[i] = new(any)
+            continue
+        }
+        dests[i] = &fieldScanner{ field: target.Field(idx) }
+    }
+    return dests
+}
+
+// columns and values written on insert - everything but the id and managed columns,
+// plus the creation timestamps
+func intoInsert(a any) ([]string, []any, error) {
+    typ := reflect.TypeOf(a)
+    fields, err := intoSqlFields(typ)
+    if err != nil {
+        return nil, nil, err
+    }
+    vals, err := intoRow(a)
+    if err != nil {
+        return nil, nil, err
+    }
+    managed := getManagedCols(typ)
+    insertFields := make([]string, 0)
+    insertVals := make([]any, 0)
+    for i := 1; i < len(fields); i++ {
+        if managed[fields[i]] {
+            continue
+        }
+        insertFields = append(insertFields, fields[i])
+        insertVals = append(insertVals, vals[i])
+    }
+    createdAt := now()
+    if col, err := getCreatedAtCol(typ); err == nil {
+        insertFields = append(insertFields, col)
+        insertVals = append(insertVals, createdAt)
+    }
+    if col, err := getUpdatedAtCol(typ); err == nil {
+        insertFields = append(insertFields, col)
+        insertVals = append(insertVals, createdAt)
+    }
+    return insertFields, insertVals, nil
 }
+
+// replaces the named @args of a query with driver placeholders, returning the
+// clause and the args in placeholder order. placeholder is given each value
+// and returns its marker
+func bindQuery(query types.Query, placeholder func(any) string) (string, []any) {
+    clause, args := query.Sql()
+    // bind in order of appearance, longest name first so @id1 doesn't clobber @id10
+    names := make([]string, 0, len(args))
+    for name := range args {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        return len(names[i]) > len(names[j])
+    })
+    type binding struct {
+        pos int
+        name string
+    }
+    bindings := make([]binding, 0)
+    masked := clause
+    for _, name := range names {
+        named := "@" + name
+        for {
+            pos := strings.Index(masked, named)
+            if pos < 0 {
+                break
+            }
+            bindings = append(bindings, binding{ pos, name })
+            masked = masked[:pos] + strings.Repeat("\x00", len(named)) + masked[pos + len(named):]
+        }
+    }
+    sort.Slice(bindings, func(i, j int) bool {
+        return bindings[i].pos < bindings[j].pos
+    })
+
+    var bound strings.Builder
+    boundArgs := make([]any, 0)
+    last := 0
+    for _, b := range bindings {
+        bound.WriteString(clause[last:b.pos])
+        bound.WriteString(placeholder(args[b.name]))
+        boundArgs = append(boundArgs, args[b.name])
+        last = b.pos + len(b.name) + 1
+    }
+    bound.WriteString(clause[last:])
+    return bound.String(), boundArgs
+}
+
+// splits queries into where clauses, order by terms and the projected columns
+func splitQueries(queries []types.Query, placeholder func(any) string) ([]string, []any, []string, []string) {
+    clauses := make([]string, 0)
+    args := make([]any, 0)
+    orderBy := make([]string, 0)
+    var columns []string
+    for _, query := range queries {
+        if ordering, ok := query.(types.Ordering); ok {
+            orderBy = append(orderBy, ordering.OrderBy()...)
+            continue
+        }
+        if projection, ok := query.(types.Projecting); ok {
+            columns = append(columns, projection.Columns()...)
+            continue
+        }
+        clause, clauseArgs := bindQuery(query, placeholder)
+        clauses = append(clauses, "(" + clause + ")")
+        args = append(args, clauseArgs...)
+    }
+    return clauses, args, orderBy, columns
+}
+
+// the select list for a query - the id plus the projected columns, or every column
+func selectFields(typ reflect.Type, projected []string) ([]string, error) {
+    fields, err := intoSqlFields(typ)
+    if err != nil {
+        return nil, err
+    }
+    if len(projected) == 0 {
+        return fields, nil
+    }
+    known := make(map[string]bool)
+    for _, field := range fields {
+        known[field] = true
+    }
+    selected := []string{glonkIdTag}
+    seen := map[string]bool{ glonkIdTag: true }
+    for _, col := range projected {
+        if !known[col] {
+            return nil, errors.New("No column " + col + " on type " + typ.Name())
+        }
+        if !seen[col] {
+            seen[col] = true
+            selected = append(selected, col)
+        }
+    }
+    return selected, nil
+}
+
+// builds the select for the records matching queries, restricted to ownerId for private types
+func byQueriesSql(metaData types.MetaData, queries []types.Query, ownerId int64, placeholder func(any) string) (string, []any, error) {
+    return liveSql(metaData, queries, true, ownerId, placeholder)
+}
+
+// builds the select for the records matching queries whoever owns them
+func referencedSql(metaData types.MetaData, queries []types.Query, placeholder func(any) string) (string, []any, error) {
+    return liveSql(metaData, queries, false, 0, placeholder)
+}
+
+func liveSql(metaData types.MetaData, queries []types.Query, owned bool, ownerId int64, placeholder func(any) string) (string, []any, error) {
+    dataType := metaData.GetType()
+    clauses, args, orderBy, projected := splitQueries(queries, placeholder)
+
+    ownerIdCol, err := getOwnerIdCol(dataType)
+    if err == nil && owned {
+        clauses = append(clauses, fmt.Sprintf("%s = %s", ownerIdCol, placeholder(ownerId)))
+        args = append(args, ownerId)
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("%s = 0", deletedAtCol))
+    }
+
+    fields, err := selectFields(dataType, projected)
+    if err != nil {
+        return "", nil, err
+    }
+    query := fmt.Sprintf("select %s from %s", strings.Join(fields, ","), metaData.TableName())
+    if len(clauses) > 0 {
+        query += " where " + strings.Join(clauses, " and ")
+    }
+    if len(orderBy) > 0 {
+        query += " order by " + strings.Join(orderBy, ", ")
+    }
+    return query, args, nil
+}
+
+// aggregate functions over a glonk column, count may omit the column to count rows
+type Aggregate struct {
+    Func string
+    Col string
+}
+
+var aggregateFuncs = map[string]bool {
+    "count": true,
+    "min": true,
+    "max": true,
+    "sum": true,
+    "avg": true,
+}
+
+// key of the aggregate in result rows - the function, or <function>_<column>
+func (a Aggregate) Name() string {
+    if a.Col == "" {
+        return a.Func
+    }
+    return a.Func + "_" + a.Col
+}
+
+var (
+    nullIntType = reflect.TypeOf(sql.NullInt64{})
+    nullFloatType = reflect.TypeOf(sql.NullFloat64{})
+)
+
+func isNumeric(typ reflect.Type) bool {
+    if typ.Kind() == reflect.Pointer {
+        typ = typ.Elem()
+    }
+    if typ == nullIntType || typ == nullFloatType {
+        return true
+    }
+    switch typ.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+        reflect.Float32, reflect.Float64:
+        return true
+    }
+    return false
+}
+
+// builds the select for aggregates over the records matching queries grouped by groupBy,
+// restricted to ownerId for private types. ordering and projections don't apply to aggregates
+func aggregateSql(metaData types.MetaData, queries []types.Query, aggregates []Aggregate, groupBy []string, ownerId int64, placeholder func(any) string) (string, []any, error) {
+    dataType := metaData.GetType()
+    indexes := glonkFieldIndexes(dataType)
+    selected := make([]string, 0)
+    for _, col := range groupBy {
+        if _, exists := indexes[col]; !exists {
+            return "", nil, errors.New("No column " + col + " on type " + dataType.Name())
+        }
+        selected = append(selected, col)
+    }
+    for _, aggregate := range aggregates {
+        if !aggregateFuncs[aggregate.Func] {
+            return "", nil, errors.New("Unknown aggregate function " + aggregate.Func)
+        }
+        if aggregate.Col == "" {
+            if aggregate.Func != "count" {
+                return "", nil, errors.New(aggregate.Func + " requires a column")
+            }
+            selected = append(selected, "count(*)")
+            continue
+        }
+        idx, exists := indexes[aggregate.Col]
+        if !exists {
+            return "", nil, errors.New("No column " + aggregate.Col + " on type " + dataType.Name())
+        }
+        switch aggregate.Func {
+        case "sum", "avg":
+            if !isNumeric(dataType.Field(idx).Type) {
+                return "", nil, errors.New(aggregate.Func + " requires a numeric column, " + aggregate.Col + " is not")
+            }
+            selected = append(selected, fmt.Sprintf("cast(%s(%s) as double precision)", aggregate.Func, aggregate.Col))
+        default:
+            selected = append(selected, fmt.Sprintf("%s(%s)", aggregate.Func, aggregate.Col))
+        }
+    }
+    if len(aggregates) == 0 {
+        return "", nil, errors.New("No aggregates requested")
+    }
+
+    filters := make([]types.Query, 0)
+    for _, query := range queries {
+        _, ordering := query.(types.Ordering)
+        _, projecting := query.(types.Projecting)
+        if !ordering && !projecting {
+            filters = append(filters, query)
+        }
+    }
+    clauses, args, _, _ := splitQueries(filters, placeholder)
+    ownerIdCol, err := getOwnerIdCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("%s = %s", ownerIdCol, placeholder(ownerId)))
+        args = append(args, ownerId)
+    }
+    deletedAtCol, err := getDeletedAtCol(dataType)
+    if err == nil {
+        clauses = append(clauses, fmt.Sprintf("%s = 0", deletedAtCol))
+    }
+
+    query := fmt.Sprintf("select %s from %s", strings.Join(selected, ","), metaData.TableName())
+    if len(clauses) > 0 {
+        query += " where " + strings.Join(clauses, " and ")
+    }
+    if len(groupBy) > 0 {
+        query += " group by " + strings.Join(groupBy, ",") + " order by " + strings.Join(groupBy, ",")
+    }
+    return query, args, nil
+}
+
+// scan targets for an aggregate row: group columns scan as their fields,
+// min and max as pointers to their fields so empty sets are null
+type aggregateRow struct {
+    groups []reflect.Value
+    extrema []reflect.Value
+    counts []int64
+    sums []sql.NullFloat64
+}
+
+func newAggregateRow(typ reflect.Type, aggregates []Aggregate, groupBy []string) (*aggregateRow, []any) {
+    indexes := glonkFieldIndexes(typ)
+    row := &aggregateRow{}
+    dest := make([]any, 0)
+    for _, col := range groupBy {
+        group := reflect.New(typ.Field(indexes[col]).Type).Elem()
+        row.groups = append(row.groups, group)
+        dest = append(dest, &fieldScanner{ field: group })
+    }
+    row.extrema = make([]reflect.Value, len(aggregates))
+    row.counts = make([]int64, len(aggregates))
+    row.sums = make([]sql.NullFloat64, len(aggregates))
+    for i, aggregate := range aggregates {
+        switch aggregate.Func {
+        case "count":
+            dest = append(dest, &row.counts[i])
+        case "sum", "avg":
+            dest = append(dest, &row.sums[i])
+        default:
+            fieldType := typ.Field(indexes[aggregate.Col]).Type
+            if fieldType.Kind() != reflect.Pointer {
+                fieldType = reflect.PointerTo(fieldType)
+            }
+            row.extrema[i] = reflect.New(fieldType).Elem()
+            dest = append(dest, &fieldScanner{ field: row.extrema[i] })
+        }
+    }
+    return row, dest
+}
+
+func (row *aggregateRow) values(aggregates []Aggregate, groupBy []string) map[string]any {
+    values := make(map[string]any)
+    for i, col := range groupBy {
+        values[col] = row.groups[i].Interface()
+    }
+    for i, aggregate := range aggregates {
+        switch aggregate.Func {
+        case "count":
+            values[aggregate.Name()] = row.counts[i]
+        case "sum", "avg":
+            if row.sums[i].Valid {
+                values[aggregate.Name()] = row.sums[i].Float64
+            } else {
+                values[aggregate.Name()] = nil
+            }
+        default:
+            values[aggregate.Name()] = row.extrema[i].Interface()
+        }
+    }
+    return values
+}
+
+// pending and completed account deletions are recorded in this table
+const accountDeletionsTable = "account_deletions"
+
+// column of tables with a trash holding the id of the account deletion that trashed a record,
+// 0 for records trashed some other way, so restoring the account only brings back its own
+const accountDeletionIdCol = "account_deletion_id"
+
+// a table holding records owned or authored by users
+type accountTable struct {
+    name string
+    writerCol string
+    // empty when the type has no trash
+    deletedAtCol string
+}
+
+// tables of every data type with an owner_id or author_id other than its own id
+func accountTables() []accountTable {
+    tables := make([]accountTable, 0)
+    for _, metaData := range types.MetaDataMap {
+        typ := metaData.GetType()
+        writerCol, err := getWriterIdCol(typ)
+        idCol, _ := getIdCol(typ)
+        if err != nil || writerCol == idCol {
+            continue
+        }
+        deletedAtCol, _ := getDeletedAtCol(typ)
+        tables = append(tables, accountTable{ name: metaData.TableName(), writerCol: writerCol, deletedAtCol: deletedAtCol })
+    }
+    sort.Slice(tables, func(i, j int) bool {
+        return tables[i].name < tables[j].name
+    })
+    return tables
+}
+
+// builds an INSERT of a new record returning the created row. placeholder returns the
+// driver's nth parameter marker
+func insertSql(data types.DataType, tableName string, placeholder func(int) string) (string, []any, error) {
+    fields, values, err := intoInsert(data)
+    if err != nil {
+        return "", nil, err
+    }
+    allFields, err := intoSqlFields(reflect.TypeOf(data))
+    if err != nil {
+        return "", nil, err
+    }
+    placeholders := make([]string, 0)
+    for i := range fields {
+        placeholders = append(placeholders, placeholder(i + 1))
+    }
+    query := fmt.Sprintf("insert into %s (%s) values (%s) returning %s", tableName, strings.Join(fields, ","), strings.Join(placeholders, ","), strings.Join(allFields, ","))
+    return query, values, nil
+}
+
+// builds an INSERT ... ON CONFLICT DO UPDATE replacing every writable column of the
+// existing row keyed by keyCol. placeholder returns the driver's nth parameter marker
+func upsertSql(data types.DataType, tableName string, keyCol string, placeholder func(int) string) (string, []any, error) {
+    typ := reflect.TypeOf(data)
+    if !isUpsertKey(typ, keyCol) {
+        return "", nil, errors.New(keyCol + " is not the id or a unique column of " + typ.Name())
+    }
+    allFields, err := intoSqlFields(typ)
+    if err != nil {
+        return "", nil, err
+    }
+    fields, values, err := intoInsert(data)
+    if err != nil {
+        return "", nil, err
+    }
+    if keyCol == glonkIdTag {
+        fields = append([]string{glonkIdTag}, fields...)
+        values = append([]any{GetId(data)}, values...)
+    }
+
+    createdAtCol, _ := getCreatedAtCol(typ)
+    placeholders := make([]string, 0)
+    setStrings := make([]string, 0)
+    for i, field := range fields {
+        placeholders = append(placeholders, placeholder(i + 1))
+        if field != keyCol && field != glonkIdTag && field != createdAtCol {
+            setStrings = append(setStrings, fmt.Sprintf("%s = excluded.%s", field, field))
+        }
+    }
+    deletedAtCol, err := getDeletedAtCol(typ)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = 0", deletedAtCol), fmt.Sprintf("%s = 0", accountDeletionIdCol))
+    }
+
+    whereStrings := make([]string, 0)
+    idCol, _ := getIdCol(typ)
+    writerIdCol, err := getWriterIdCol(typ)
+    if err == nil && writerIdCol != idCol {
+        whereStrings = append(whereStrings, fmt.Sprintf("%s.%s = excluded.%s", tableName, writerIdCol, writerIdCol))
+    }
+    versionCol, err := getVersionCol(typ)
+    if err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = %s.%s + 1", versionCol, tableName, versionCol))
+        version, err := GetVersion(data)
+        if err == nil && version != 0 {
+            values = append(values, version)
+            whereStrings = append(whereStrings, fmt.Sprintf("%s.%s = %s", tableName, versionCol, placeholder(len(values))))
+        }
+    }
+
+    query := fmt.Sprintf("insert into %s (%s) values (%s) on conflict (%s) do update set %s", tableName, strings.Join(fields, ","), strings.Join(placeholders, ","), keyCol, strings.Join(setStrings, ", "))
+    if len(whereStrings) > 0 {
+        query += " where " + strings.Join(whereStrings, " and ")
+    }
+    query += " returning " + strings.Join(allFields, ",")
+    return query, values, nil
+}
+
+// sets every column of a live record but its writer and created_at, conditional on its
+// version unless that's 0. unlike an upsert it never revives a trashed record
+func replaceSql(data types.DataType, tableName string, placeholder func(int) string) (string, []any, bool, error) {
+    typ := reflect.TypeOf(data)
+    allFields, err := intoSqlFields(typ)
+    if err != nil {
+        return "", nil, false, err
+    }
+    fields, values, err := intoInsert(data)
+    if err != nil {
+        return "", nil, false, err
+    }
+    writerIdCol, err := getWriterIdCol(typ)
+    if err != nil {
+        return "", nil, false, err
+    }
+    writerId, err := GetWriterId(data)
+    if err != nil {
+        return "", nil, false, err
+    }
+    createdAtCol, _ := getCreatedAtCol(typ)
+
+    args := make([]any, 0)
+    setStrings := make([]string, 0)
+    for i, field := range fields {
+        if field == writerIdCol || field == createdAtCol {
+            continue
+        }
+        args = append(args, values[i])
+        setStrings = append(setStrings, fmt.Sprintf("%s = %s", field, placeholder(len(args))))
+    }
+    args = append(args, GetId(data), writerId)
+    whereString := fmt.Sprintf("id = %s and %s = %s", placeholder(len(args) - 1), writerIdCol, placeholder(len(args)))
+    if deletedAtCol, err := getDeletedAtCol(typ); err == nil {
+        whereString += fmt.Sprintf(" and %s = 0", deletedAtCol)
+    }
+    versionChecked := false
+    if versionCol, err := getVersionCol(typ); err == nil {
+        setStrings = append(setStrings, fmt.Sprintf("%s = %s + 1", versionCol, versionCol))
+        if version, err := GetVersion(data); err == nil && version != 0 {
+            args = append(args, version)
+            whereString += fmt.Sprintf(" and %s = %s", versionCol, placeholder(len(args)))
+            versionChecked = true
+        }
+    }
+    query := fmt.Sprintf("update %s set %s where %s returning %s", tableName, strings.Join(setStrings, ", "), whereString, strings.Join(allFields, ","))
+    return query, args, versionChecked, nil
+}
+
+// whether an upsert that wrote nothing lost on the version rather than the stored record
+// belonging to someone else. others aren't told the record exists
+func upsertConflict(data types.DataType, found bool, storedWriterId int64) bool {
+    writerId, err := GetWriterId(data)
+    if err != nil || !found || storedWriterId != writerId {
+        return false
+    }
+    version, err := GetVersion(data)
+    return err == nil && version != 0
+}
+
+// yields each row scanned into dt, closing rows when done
+func scanRows(rows *sql.Rows, dt reflect.Type) iter.Seq2[types.DataType, error] {
+	return func(yield func(types.DataType, error) bool) {
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for rows.Next() {
+			targetData := reflect.New(dt).Elem()
+			if err := rows.Scan(scanDestinations(targetData, columns)...); err != nil {
+				yield(nil, err)
+				return
+			}
+			td, ok := targetData.Interface().(types.DataType)
+			if ok && !yield(td, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func scanType(rows *sql.Rows, dt reflect.Type) ([]types.DataType, error) {
+	return collect(scanRows(rows, dt))
+}
+
+// the records of seq, stopping at the first error
+func collect(seq iter.Seq2[types.DataType, error]) ([]types.DataType, error) {
+	data := make([]types.DataType, 0)
+	for td, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, td)
+	}
+	return data, nil
+}
+
+func sparseUpdate(dt types.DataType) (map[string]any, error) {
+    fields, err := intoSqlFields(reflect.TypeOf(dt))
+    if err != nil {
+        return nil, err
+    }
+
+    vals, err := intoRow(dt)
+    if err != nil {
+        return nil, err
+    }
+    managed := getManagedCols(reflect.TypeOf(dt))
+    resultMap := make(map[string]any, 0)
+    for i := 0; i < len(fields); i++ {
+        if vals[i] != nil && !managed[fields[i]] {
+            resultMap[fields[i]] = vals[i]
+        }
+    }
+    return resultMap, nil
+}
+
+type NoRows struct {}
+func (NoRows) Error() string {
+	return "No rows found"
+}
+
+// an upsert by id creating a record at an id the table hasn't handed out yet. explicit
+// ids would move the shared id sequence, so only those of since deleted records are reused
+type UnallocatedId struct {}
+func (UnallocatedId) Error() string {
+	return "Id has not been allocated"
+}
+
+type VersionConflict struct {}
+func (VersionConflict) Error() string {
+	return "Version does not match stored version"
+}
+
+const auditTable = "audit_log"
+
+// an entry of the append-only audit log
+type AuditEntry struct {
+    Id int64 `json:"id"`
+    At time.Time `json:"at"`
+    // the session's user, 0 when there was none
+    ActorId int64 `json:"actor_id"`
+    // the user whose account or records the entry concerns
+    SubjectId int64 `json:"subject_id"`
+    Action string `json:"action"`
+    DataType string `json:"data_type,omitempty"`
+    RecordId int64 `json:"record_id,omitempty"`
+    // changed fields as {"field": {"before": ..., "after": ...}}
+    Diff map[string]any `json:"diff,omitempty"`
+    Ip string `json:"ip"`
+    RequestId string `json:"request_id"`
+}
+
+// narrows audit log reads, zero values match everything
+type AuditFilter struct {
+    ActorId int64
+    SubjectId int64
+    Action string
+    DataType string
+    RecordId int64
+    Since time.Time
+    Until time.Time
+    // only entries older than this id, for paging
+    BeforeId int64
+    Limit int
+}
+
+var auditCols = []string{ "id", "at", "actor_id", "subject_id", "action", "data_type", "record_id", "diff", "ip", "request_id" }
+
+func appendAuditSql(entry AuditEntry, placeholder func(int) string) (string, []any, error) {
+    var diff []byte
+    if len(entry.Diff) > 0 {
+        encoded, err := json.Marshal(entry.Diff)
+        if err != nil {
+            return "", nil, err
+        }
+        diff = encoded
+    }
+    placeholders := make([]string, 0)
+    for i := 1; i < len(auditCols); i++ {
+        placeholders = append(placeholders, placeholder(i))
+    }
+    query := fmt.Sprintf("insert into %s (%s) values (%s)", auditTable, strings.Join(auditCols[1:], ","), strings.Join(placeholders, ","))
+    values := []any{ entry.At, entry.ActorId, entry.SubjectId, entry.Action, entry.DataType, entry.RecordId, diff, entry.Ip, entry.RequestId }
+    return query, values, nil
+}
+
+func getAuditSql(filter AuditFilter, placeholder func(any) string) (string, []any) {
+    clauses := make([]string, 0)
+    args := make([]any, 0)
+    where := func(clause string, arg any) {
+        clauses = append(clauses, fmt.Sprintf(clause, placeholder(arg)))
+        args = append(args, arg)
+    }
+    if filter.ActorId != 0 {
+        where("actor_id = %s", filter.ActorId)
+    }
+    if filter.SubjectId != 0 {
+        where("subject_id = %s", filter.SubjectId)
+    }
+    if filter.Action != "" {
+        where("action = %s", filter.Action)
+    }
+    if filter.DataType != "" {
+        where("data_type = %s", filter.DataType)
+    }
+    if filter.RecordId != 0 {
+        where("record_id = %s", filter.RecordId)
+    }
+    if !filter.Since.IsZero() {
+        where("at >= %s", filter.Since)
+    }
+    if !filter.Until.IsZero() {
+        where("at < %s", filter.Until)
+    }
+    if filter.BeforeId != 0 {
+        where("id < %s", filter.BeforeId)
+    }
+    query := fmt.Sprintf("select %s from %s", strings.Join(auditCols, ","), auditTable)
+    if len(clauses) > 0 {
+        query += " where " + strings.Join(clauses, " and ")
+    }
+    query += " order by id desc"
+    if filter.Limit > 0 {
+        query += fmt.Sprintf(" limit %d", filter.Limit)
+    }
+    return query, args
+}
+
+// scan destinations for an audit row, decode finishes the entry once scanned
+type auditRow struct {
+    entry AuditEntry
+    diff []byte
+}
+
+func (row *auditRow) dests() []any {
+    e := &row.entry
+    return []any{ &e.Id, &e.At, &e.ActorId, &e.SubjectId, &e.Action, &e.DataType, &e.RecordId, &row.diff, &e.Ip, &e.RequestId }
+}
+
+func (row *auditRow) decode() (AuditEntry, error) {
+    row.entry.At = row.entry.At.UTC()
+    if len(row.diff) > 0 {
+        if err := json.Unmarshal(row.diff, &row.entry.Diff); err != nil {
+            return AuditEntry{}, err
+        }
+    }
+    return row.entry, nil
+}
+
+const rateLimitsTable = "rate_limits"
+
+// a token bucket budget, Burst tokens refilled at Rate per second
+type RateLimit struct {
+    Rate float64
+    Burst int
+}
+
+// the state of a token bucket
+type Bucket struct {
+    Tokens float64
+    Updated time.Time
+}
+
+// a full bucket for limit
+func NewBucket(limit RateLimit, now time.Time) Bucket {
+    return Bucket{ Tokens: float64(limit.Burst), Updated: now }
+}
+
+// refills the bucket for the time since it was last updated and takes a token,
+// returning the new state and, when it was empty, how long until a token is available
+func (b Bucket) Take(limit RateLimit, now time.Time) (Bucket, bool, time.Duration) {
+    elapsed := now.Sub(b.Updated).Seconds()
+    if elapsed > 0 {
+        b.Tokens = min(float64(limit.Burst), b.Tokens + elapsed * limit.Rate)
+        b.Updated = now
+    }
+    if b.Tokens >= 1 {
+        b.Tokens -= 1
+        return b, true, 0
+    }
+    if limit.Rate <= 0 {
+        return b, false, time.Hour
+    }
+    wait := time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+    return b, false, wait
+}
+
+const quotaOverridesTable = "quota_overrides"
+
+// limits on what a user may store of a data type, 0 is unlimited
+type Quota struct {
+    MaxRecords int64 `json:"max_records"`
+    MaxBytes int64 `json:"max_bytes"`
+}
+
+// what a user stores of a data type
+type Usage struct {
+    Records int64 `json:"records"`
+    Bytes int64 `json:"bytes"`
+}
+
+const quotaLocksTable = "quota_locks"
+
+// how long a quota lock is held at most, so a server that dies holding one doesn't block its user for good
+const quotaLockLease = 30 * time.Second
+
+// how often a quota lock held by someone else is tried again
+const quotaLockRetry = 10 * time.Millisecond
+
+// retries acquire until it takes the lock at key under a new holder, returning the release
+func lockQuota(dataType string, ownerId int64, acquire func(key string, holder string) (bool, error), release func(key string, holder string) error) (func() error, error) {
+    key := fmt.Sprintf("%s:%d", dataType, ownerId)
+    random := make([]byte, 16)
+    if _, err := rand.Read(random); err != nil {
+        return nil, err
+    }
+    holder := hex.EncodeToString(random)
+    for {
+        acquired, err := acquire(key, holder)
+        if err != nil {
+            return nil, err
+        }
+        if acquired {
+            return func() error { return release(key, holder) }, nil
+        }
+        time.Sleep(quotaLockRetry)
+    }
+}
+
+// columns stored as text or bytes, the ones counted towards a record's size
+func getSizedCols(typ reflect.Type) []string {
+    cols := make([]string, 0)
+    for i := 0; i < typ.NumField(); i++ {
+        field := typ.Field(i)
+        glonkName, err := getGlonkName(field)
+        if err != nil {
+            continue
+        }
+        fieldType := field.Type
+        if fieldType.Kind() == reflect.Pointer {
+            fieldType = fieldType.Elem()
+        }
+        if fieldType.Kind() == reflect.String || fieldType == bytesType || isJsonField(fieldType) {
+            cols = append(cols, glonkName)
+        }
+    }
+    return cols
+}
+
+var bytesType = reflect.TypeOf([]byte{})
+
+// bytes of a record's text columns as they're stored
+func RecordBytes(data types.DataType) (int64, error) {
+    row, err := sizedRow(data, false)
+    if err != nil {
+        return 0, err
+    }
+    var size int64
+    for _, value := range row {
+        size += valueBytes(value)
+    }
+    return size, nil
+}
+
+// the change in a stored record's bytes when a sparse update is applied to it
+func UpdatedBytes(stored types.DataType, update types.DataType) (int64, error) {
+    before, err := sizedRow(stored, false)
+    if err != nil {
+        return 0, err
+    }
+    after, err := sizedRow(update, true)
+    if err != nil {
+        return 0, err
+    }
+    var change int64
+    for col, value := range after {
+        change += valueBytes(value) - valueBytes(before[col])
+    }
+    return change, nil
+}
+
+// sized column values of a record, only those a sparse update writes when sparse
+func sizedRow(data types.DataType, sparse bool) (map[string]any, error) {
+    var row map[string]any
+    if sparse {
+        var err error
+        if row, err = sparseUpdate(data); err != nil {
+            return nil, err
+        }
+    } else {
+        fields, err := intoSqlFields(reflect.TypeOf(data))
+        if err != nil {
+            return nil, err
+        }
+        vals, err := intoRow(data)
+        if err != nil {
+            return nil, err
+        }
+        row = make(map[string]any, len(fields))
+        for i := range fields {
+            row[fields[i]] = vals[i]
+        }
+    }
+    sized := make(map[string]any)
+    for _, col := range getSizedCols(reflect.TypeOf(data)) {
+        if value, exists := row[col]; exists {
+            sized[col] = value
+        }
+    }
+    return sized, nil
+}
+
+func valueBytes(value any) int64 {
+    switch v := value.(type) {
+    case string:
+        return int64(len(v))
+    case []byte:
+        return int64(len(v))
+    }
+    return 0
+}
+
+// counts the writer's records and sums the byte length of their sized columns.
+// byteLength wraps a column in the driver's byte length function
+func usageSql(metaData types.MetaData, ownerId int64, byteLength func(string) string, placeholder string) (string, []any, error) {
+    dataType := metaData.GetType()
+    writerCol, err := getWriterIdCol(dataType)
+    if err != nil {
+        return "", nil, err
+    }
+    size := "0"
+    for _, col := range getSizedCols(dataType) {
+        size += fmt.Sprintf(" + coalesce(%s, 0)", byteLength(col))
+    }
+    query := fmt.Sprintf("select count(*), coalesce(sum(%s), 0) from %s where %s = %s", size, metaData.TableName(), writerCol, placeholder)
+    return query, []any{ownerId}, nil
+}
+
@@ -0,0 +1,34 @@
+package types
+
+import (
+    "reflect"
+    "strings"
+)
+
+// validation constraints declared in glonk tags
+//  required: the field may not be its zero value
+type Constraints struct {
+    Required bool
+}
+
+func FieldConstraints(field reflect.StructField) Constraints {
+    var constraints Constraints
+    for _, tag := range strings.Split(field.Tag.Get("glonk"), ",")[1:] {
+        if tag == "required" {
+            constraints.Required = true
+        }
+    }
+    return constraints
+}
+
+// checks every field of a data type against its declared constraints
+func CheckConstraints(dt DataType) bool {
+    val := reflect.ValueOf(dt)
+    typ := val.Type()
+    for i := 0; i < typ.NumField(); i++ {
+        if FieldConstraints(typ.Field(i)).Required && val.Field(i).IsZero() {
+            return false
+        }
+    }
+    return true
+}
@@ -1,7 +1,6 @@
 package types
 
 import (
-    "strings"
     "reflect"
     "net/http"
 )
@@ -13,18 +12,6 @@ var MetaDataMap metaDataMap = metaDataMap {
     "post": PostMeta,
 }
 
-func (mdm metaDataMap) MarshalJSON() ([]byte, error) {
-    jsonStrings := make([]string, 0)
-    for dataType, md := range mdm {
-        queryNames := make([]string, 0)
-        for query, _ := range md.GetQueries() {
-            queryNames = append(queryNames,`"` + query + `"`)
-        }
-        jsonStrings = append(jsonStrings, `"` + dataType + `":{"queries":[` + strings.Join(queryNames, ",") + `]}`)
-    }
-    return []byte(`{` + strings.Join(jsonStrings, ",") + `}`), nil
-}
-
 // data struct interface
 type DataType interface {
     Validate() bool
@@ -42,6 +29,8 @@ type Decoder = func(*http.Request) (DataType, error)
 type QueryBuilder struct {
     Field string
     Parser func(string, []string) (Query, error)
+    // how the query param's value is written, for documentation
+    Format string
 }
 type Queries = map[string]QueryBuilder
 
@@ -49,4 +38,14 @@ type Query interface {
     Sql() (string, map[string]any)
 }
 
+// queries that order results rather than filter them
+type Ordering interface {
+    OrderBy() []string
+}
+
+// queries that narrow the columns selected rather than filter rows
+type Projecting interface {
+    Columns() []string
+}
+
 
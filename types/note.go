@@ -1,6 +1,7 @@
 package types
 
 import (
+    "time"
     "reflect"
     "net/http"
     "encoding/json"
@@ -9,12 +10,16 @@ import (
 // Note data type
 type Note struct {
     ID int64 `json:"id" glonk:"id"`
-    OwnerId int64 `json:"owner_id" glonk:"owner_id"`
-    Contents string `json:"contents" glonk:"contents"`
+    OwnerId int64 `json:"owner_id" glonk:"owner_id,belongs_to=user"`
+    Contents string `json:"contents" glonk:"contents,searchable,required"`
+    DeletedAt int64 `json:"deleted_at" glonk:"deleted_at"`
+    Version int64 `json:"version" glonk:"version"`
+    CreatedAt time.Time `json:"created_at" glonk:"created_at"`
+    UpdatedAt time.Time `json:"updated_at" glonk:"updated_at"`
 }
 
 func (n Note) IntoRow() []any {
-    return []any{ n.ID, n.OwnerId, n.Contents }
+    return []any{ n.ID, n.OwnerId, n.Contents, n.DeletedAt, n.Version, n.CreatedAt, n.UpdatedAt }
 }
 
 func (n Note) TypeString() string {
@@ -22,7 +27,7 @@ func (n Note) TypeString() string {
 }
 
 func (n Note) Validate() bool {
-    return len(n.Contents) > 0
+    return CheckConstraints(n)
 }
 
 // Decoders
@@ -37,10 +42,13 @@ type noteMeta struct {}
 var NoteMeta noteMeta = noteMeta {}
 var (
     NoteQueries = Queries {
-        "byOwnerId": { "owner_id", ByIdFieldFromQueryParam },
-        "byContentContains": { "contents", ByContainsFromQueryParam },
+        "byOwnerId": { "owner_id", ByIdFieldFromQueryParam, IdListFormat },
+        "byContentContains": { "contents", ByContainsFromQueryParam, ContainsFormat },
+        "byCreatedAt": { "created_at", ByTimeRangeFromQueryParam, TimeRangeFormat },
+        "byUpdatedAt": { "updated_at", ByTimeRangeFromQueryParam, TimeRangeFormat },
+        "sort": { "id,created_at,updated_at", SortFromQueryParam, SortFormat },
     }
-    noteFields = []string{ "id", "owner_id", "contents" }
+    noteFields = []string{ "id", "owner_id", "contents", "deleted_at", "version", "created_at", "updated_at" }
     noteTableName = "notes"
     noteTypeString = "note"
     noteDecoder = DecodeNoteJson
@@ -1,6 +1,7 @@
 package types
 
 import (
+    "time"
     "reflect"
     "net/http"
     "encoding/json"
@@ -9,8 +10,12 @@ import (
 // Post data type
 type Post struct {
     ID int64 `json:"id" glonk:"id"`
-    AuthorId int64 `json:"author_id" glonk:"author_id"`
-    Contents string `json:"contents" glonk:"contents"`
+    AuthorId int64 `json:"author_id" glonk:"author_id,belongs_to=user"`
+    Contents string `json:"contents" glonk:"contents,searchable,required"`
+    DeletedAt int64 `json:"deleted_at" glonk:"deleted_at"`
+    Version int64 `json:"version" glonk:"version"`
+    CreatedAt time.Time `json:"created_at" glonk:"created_at"`
+    UpdatedAt time.Time `json:"updated_at" glonk:"updated_at"`
 }
 
 func (p Post) TypeString() string {
@@ -18,7 +23,7 @@ func (p Post) TypeString() string {
 }
 
 func (p Post) Validate() bool {
-    return len(p.Contents) > 0
+    return CheckConstraints(p)
 }
 
 // Decoders
@@ -33,10 +38,13 @@ type postMeta struct {}
 var PostMeta postMeta = postMeta {}
 var (
     PostQueries = Queries {
-        "byAuthorId": { "author_id", ByIdFieldFromQueryParam },
-        "byContentContains": { "contents", ByContainsFromQueryParam },
+        "byAuthorId": { "author_id", ByIdFieldFromQueryParam, IdListFormat },
+        "byContentContains": { "contents", ByContainsFromQueryParam, ContainsFormat },
+        "byCreatedAt": { "created_at", ByTimeRangeFromQueryParam, TimeRangeFormat },
+        "byUpdatedAt": { "updated_at", ByTimeRangeFromQueryParam, TimeRangeFormat },
+        "sort": { "id,created_at,updated_at", SortFromQueryParam, SortFormat },
     }
-    postFields = []string{ "id", "author_id", "contents" }
+    postFields = []string{ "id", "author_id", "contents", "deleted_at", "version", "created_at", "updated_at" }
     postTableName = "posts"
     postTypeString = "post"
     postDecoder = DecodePostJson
@@ -4,10 +4,20 @@ import (
     "fmt"
     "strings"
     "strconv"
+    "time"
 )
 
 // Query types
 
+// formats of the query params parsed below
+const (
+    IdListFormat = "ids separated by |"
+    ContainsFormat = "substring to match"
+    TimeRangeFormat = "op:value bounds separated by |, values are RFC 3339 times and ops are eq, gt, gte, lt or lte"
+    IntRangeFormat = "op:value bounds separated by |, values are integers and ops are eq, gt, gte, lt or lte"
+    SortFormat = "comma separated columns, prefixed with - for descending"
+)
+
 // Id query
 type ById struct {
     field string
@@ -29,6 +39,10 @@ func ByIdFieldFromQueryParam(field string, queryParams []string) (Query, error)
     return &ById { field: field, ids: ids }, nil
 }
 
+func NewById(field string, ids []int64) Query {
+    return &ById { field: field, ids: ids }
+}
+
 func (q *ById) Sql() (string, map[string]any) {
     clauses := make([]string, 0)
     args := make(map[string]any)
@@ -59,3 +73,127 @@ func (q *ByContains) Sql() (string, map[string]any) {
 }
 
 
+
+// Range query over an ordered column, params are op:value pairs
+// e.g. byCreatedAt=gte:2024-01-01T00:00:00Z&byCreatedAt=lt:2024-02-01T00:00:00Z
+type ByRange struct {
+    field string
+    ops []string
+    vals []any
+}
+
+var rangeOps = map[string]string {
+    "eq": "=",
+    "gt": ">",
+    "gte": ">=",
+    "lt": "<",
+    "lte": "<=",
+}
+
+func parseRange(field string, queryParams []string, parse func(string) (any, error)) (Query, error) {
+    q := &ByRange{ field: field }
+    for _, queryParam := range queryParams {
+        for _, bound := range strings.Split(queryParam, "|") {
+            opStr, valStr, found := strings.Cut(bound, ":")
+            if !found {
+                return nil, fmt.Errorf("Range bound %s must be op:value", bound)
+            }
+            op, exists := rangeOps[opStr]
+            if !exists {
+                return nil, fmt.Errorf("Unknown range operator %s", opStr)
+            }
+            val, err := parse(valStr)
+            if err != nil {
+                return nil, err
+            }
+            q.ops = append(q.ops, op)
+            q.vals = append(q.vals, val)
+        }
+    }
+    if len(q.ops) == 0 {
+        return nil, fmt.Errorf("At least one range bound required")
+    }
+    return q, nil
+}
+
+func ByTimeRangeFromQueryParam(field string, queryParams []string) (Query, error) {
+    return parseRange(field, queryParams, func(s string) (any, error) {
+        t, err := time.Parse(time.RFC3339Nano, s)
+        if err != nil {
+            return nil, err
+        }
+        return t.UTC(), nil
+    })
+}
+
+func ByIntRangeFromQueryParam(field string, queryParams []string) (Query, error) {
+    return parseRange(field, queryParams, func(s string) (any, error) {
+        return strconv.ParseInt(s, 10, 64)
+    })
+}
+
+func (q *ByRange) Sql() (string, map[string]any) {
+    clauses := make([]string, 0)
+    args := make(map[string]any)
+    for i := 0; i < len(q.ops); i++ {
+        clauses = append(clauses, fmt.Sprintf("%s %s @%sRange%d", q.field, q.ops[i], q.field, i))
+        args[fmt.Sprintf("%sRange%d", q.field, i)] = q.vals[i]
+    }
+    return strings.Join(clauses, " and "), args
+}
+
+// Sort ordering, field holds the comma separated sortable columns
+// e.g. sort=-created_at,id
+type Sort struct {
+    terms []string
+}
+
+func SortFromQueryParam(field string, queryParams []string) (Query, error) {
+    allowed := strings.Split(field, ",")
+    terms := make([]string, 0)
+    for _, queryParam := range queryParams {
+        for _, col := range strings.Split(queryParam, ",") {
+            direction := "asc"
+            if strings.HasPrefix(col, "-") {
+                direction = "desc"
+                col = col[1:]
+            }
+            valid := false
+            for _, a := range allowed {
+                if a == col {
+                    valid = true
+                }
+            }
+            if !valid {
+                return nil, fmt.Errorf("Cannot sort by %s, sortable columns are %s", col, field)
+            }
+            terms = append(terms, col + " " + direction)
+        }
+    }
+    return &Sort{ terms: terms }, nil
+}
+
+func (q *Sort) Sql() (string, map[string]any) {
+    return "", map[string]any{}
+}
+
+func (q *Sort) OrderBy() []string {
+    return q.terms
+}
+
+// Projection of the selected columns, the id is always selected
+type Projection struct {
+    columns []string
+}
+
+func NewProjection(columns []string) Query {
+    return &Projection{ columns: columns }
+}
+
+func (q *Projection) Sql() (string, map[string]any) {
+    return "", map[string]any{}
+}
+
+func (q *Projection) Columns() []string {
+    return q.columns
+}
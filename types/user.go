@@ -1,6 +1,7 @@
 package types
 
 import (
+    "time"
     "net/http"
     "reflect"
     "encoding/json"
@@ -8,11 +9,13 @@ import (
 
 // User data type
 type User struct {
-    ID int64 `json:"id" glonk:"id,owner_id"`
-    Guid string `json:"guid" glonk:"guid"`
-    Name string `json:"name" glonk:"name"`
-    Email string `json:"email" glonk:"email"`
+    ID int64 `json:"id" glonk:"id,owner_id,has_many=note.owner_id,has_many=post.author_id"`
+    Guid string `json:"guid" glonk:"guid,unique,server_only,required"`
+    Name string `json:"name" glonk:"name,required"`
+    Email string `json:"email" glonk:"email,owner_only"`
     Picture string `json:"picture" glonk:"picture"`
+    CreatedAt time.Time `json:"created_at" glonk:"created_at"`
+    UpdatedAt time.Time `json:"updated_at" glonk:"updated_at"`
 }
 
 func (u User) TypeString() string {
@@ -20,7 +23,7 @@ func (u User) TypeString() string {
 }
 
 func (u User) Validate() bool {
-    return len(u.Name) > 0 && len(u.Guid) > 0
+    return CheckConstraints(u)
 }
 
 // Decoders
@@ -37,7 +40,7 @@ var UserMeta userMeta = userMeta {}
 var (
     UserQueries = Queries {}
     userTableName = "users"
-    userFields = []string{ "id", "guid", "name", "email", "picture" }
+    userFields = []string{ "id", "guid", "name", "email", "picture", "created_at", "updated_at" }
     userTypeString = "user"
     userDecoder = DecodeUserJson
     userType = reflect.TypeOf(User{})